@@ -7,13 +7,16 @@ import (
 	"gemini-whatsapp-bot/internal/db"
 	"gemini-whatsapp-bot/internal/i18n"
 	"gemini-whatsapp-bot/internal/knowledge"
+	"gemini-whatsapp-bot/internal/tts"
 	geminiClient "gemini-whatsapp-bot/pkg/gemini"
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 
 	_ "github.com/mattn/go-sqlite3"
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
 	_ "modernc.org/sqlite"
 
 	"go.mau.fi/whatsmeow"
@@ -28,9 +31,29 @@ func main() {
 	db := db.New("bot_store.db")
 	db.InitSchema()
 	bundle := i18n.NewBundle()
-	gemini := geminiClient.New(cfg.GeminiAPIKeys)
-	knowledge := knowledge.Load(cfg.KnowledgeFile)
-
+	safetySettings, err := geminiClient.SafetySettings(cfg.SafetyThreshold)
+	if err != nil {
+		log.Fatalf("Invalid GEMINI_SAFETY_THRESHOLD: %v", err)
+	}
+	gemini := geminiClient.New(cfg.GeminiAPIKeys, geminiClient.Options{
+		Model:           cfg.GeminiModel,
+		FallbackModels:  cfg.FallbackModels,
+		Temperature:     cfg.Temperature,
+		TopP:            cfg.TopP,
+		MaxOutputTokens: cfg.MaxOutputTokens,
+		SafetySettings:  safetySettings,
+	})
+	prices, err := geminiClient.ParsePrices(cfg.ModelPrices)
+	if err != nil {
+		log.Fatalf("Invalid MODEL_PRICES: %v", err)
+	}
+	knowledgeBase := knowledge.Load(cfg.KnowledgeFile)
+	var retriever *knowledge.Index
+	var reindex *reindexer
+	if cfg.KnowledgeDocsDir != "" {
+		retriever = newRetriever(cfg, db, gemini)
+		reindex = &reindexer{index: retriever}
+	}
 
 	dbLog := waLog.Stdout("Database", "INFO", true)
 	container, err := sqlstore.New(context.Background(), "sqlite3", "file:bot_device.db?_foreign_keys=on", dbLog)
@@ -46,16 +69,19 @@ func main() {
 	client := whatsmeow.NewClient(deviceStore, clientLog)
 
 	handler := &bot.BotHandler{
-		Client: client,
-		DB:     db,
-		Bundle: bundle,
-		Gemini: gemini,
-		Knowledge:        knowledge,
-		KnowledgeEnabled: cfg.KnowledgeEnabled,
-		StoreLatitude:    cfg.StoreLatitude,
-		StoreLongitude:   cfg.StoreLongitude,
-		MenuImagePath:    cfg.MenuImagePath,
+		Client:    client,
+		DB:        db,
+		Gemini:    gemini,
+		Retriever: retriever,
+		Queue:     bot.NewChatQueue(cfg.GeminiConcurrency, cfg.ChatQueueDepth),
+		Commands:  bot.DefaultCommands(),
+		MediaDir:  cfg.MediaDir,
+
+		SenderLimiter: bot.NewRateLimiter(cfg.SenderRateLimit, cfg.SenderRateBurst),
+		ChatLimiter:   bot.NewRateLimiter(cfg.ChatRateLimit, cfg.ChatRateBurst),
 	}
+	handler.SetSettings(newSettings(cfg, bundle, knowledgeBase, prices))
+	handler.PruneMedia()
 	client.AddEventHandler(handler.EventHandler)
 
 	if client.Store.ID == nil {
@@ -80,9 +106,162 @@ func main() {
 	}
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range c {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		reload(handler, reindex)
+	}
 
 	client.Disconnect()
+	if err := gemini.Close(); err != nil {
+		log.Printf("Failed to close Gemini client: %v", err)
+	}
 	log.Println("Bot shut down gracefully")
-}
\ No newline at end of file
+}
+
+// newSettings collects the parts of cfg that SIGHUP may replace.
+func newSettings(cfg *config.Config, bundle *goi18n.Bundle, knowledgeBase *knowledge.Knowledge, prices map[string]geminiClient.Price) *bot.Settings {
+	settings := &bot.Settings{
+		Bundle:             bundle,
+		Knowledge:          knowledgeBase,
+		KnowledgeEnabled:   cfg.KnowledgeEnabled,
+		RetrievalTopK:      cfg.KnowledgeTopK,
+		HistoryTokenBudget: cfg.HistoryTokenBudget,
+		StoreLatitude:      cfg.StoreLatitude,
+		StoreLongitude:     cfg.StoreLongitude,
+		StoreName:          cfg.StoreName,
+		StoreAddress:       cfg.StoreAddress,
+		MenuImagePaths:     cfg.MenuImagePaths,
+		MenuPDFPath:        cfg.MenuPDFPath,
+		OrderStatusURL:     cfg.OrderStatusURL,
+		StreamReplies:      cfg.StreamReplies,
+		TriggerKeywords:    cfg.TriggerKeywords,
+		OwnerJIDs:          cfg.OwnerJIDs,
+		AccessMode:         cfg.AccessMode,
+		AccessDeniedNotice: cfg.AccessDeniedNotice,
+		DailyMessageQuota:  cfg.DailyMessageQuota,
+		DailyTokenQuota:    cfg.DailyTokenQuota,
+		ModelPrices:        prices,
+		ResponseCacheTTL:   cfg.ResponseCacheTTL,
+		AvailableModels:    cfg.AvailableModels,
+	}
+	if cfg.TTSCommand != "" {
+		settings.TTS = tts.Command{Shell: cfg.TTSCommand}
+	}
+	return settings
+}
+
+// reload re-reads .env, the translation files and the knowledge file and
+// swaps them into the running bot. If any of them is invalid the bot keeps
+// its current settings. The knowledge documents are then reindexed in the
+// background. API keys, the database and the Gemini defaults are only read at
+// startup.
+func reload(handler *bot.BotHandler, reindex *reindexer) {
+	log.Println("Reloading configuration...")
+
+	cfg, err := config.Reload()
+	if err != nil {
+		log.Printf("Reload failed, keeping the current configuration: %v", err)
+		return
+	}
+	bundle, err := i18n.LoadBundle()
+	if err != nil {
+		log.Printf("Reload failed, keeping the current configuration: %v", err)
+		return
+	}
+	knowledgeBase, err := knowledge.LoadFile(cfg.KnowledgeFile)
+	if err != nil {
+		log.Printf("Reload failed, keeping the current configuration: invalid knowledge file %s: %v", cfg.KnowledgeFile, err)
+		return
+	}
+
+	prices, err := geminiClient.ParsePrices(cfg.ModelPrices)
+	if err != nil {
+		log.Printf("Reload failed, keeping the current configuration: invalid MODEL_PRICES: %v", err)
+		return
+	}
+
+	handler.SetSettings(newSettings(cfg, bundle, knowledgeBase, prices))
+	log.Println("Configuration reloaded")
+
+	if reindex != nil && cfg.KnowledgeDocsDir != "" {
+		reindex.start(cfg.KnowledgeDocsDir)
+	}
+}
+
+// reindexer rebuilds the knowledge index in the background, so that the
+// signal loop keeps handling signals while documents are embedded. Builds
+// never overlap: a reload during a build queues one more build of the
+// latest directory once it finishes.
+type reindexer struct {
+	index *knowledge.Index
+
+	mu      sync.Mutex
+	running bool
+	pending string
+}
+
+func (r *reindexer) start(dir string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running {
+		log.Printf("Knowledge documents are being indexed, reindexing %s once that finishes", dir)
+		r.pending = dir
+		return
+	}
+	r.running = true
+	go r.run(dir)
+}
+
+func (r *reindexer) run(dir string) {
+	for {
+		if err := r.index.Build(dir); err != nil {
+			log.Printf("Failed to reindex knowledge documents in %s: %v", dir, err)
+		} else {
+			log.Printf("Reindexed knowledge documents in %s", dir)
+		}
+
+		r.mu.Lock()
+		dir, r.pending = r.pending, ""
+		if dir == "" {
+			r.running = false
+			r.mu.Unlock()
+			return
+		}
+		r.mu.Unlock()
+	}
+}
+
+// newRetriever indexes the documents in KNOWLEDGE_DOCS_DIR. Embeddings come
+// from the Gemini API, and PDFs are converted to text by Gemini. Both are
+// recorded as indexing requests in the token usage.
+func newRetriever(cfg *config.Config, database *db.Database, gemini *geminiClient.Client) *knowledge.Index {
+	model := cfg.EmbeddingModel
+	if model == "" {
+		model = geminiClient.DefaultEmbeddingModel
+	}
+	embedder := knowledge.EmbedderFunc(func(texts []string) ([][]float32, error) {
+		vectors, res, err := gemini.EmbedTexts(model, texts)
+		if err != nil {
+			return nil, err
+		}
+		bot.RecordIndexUsage(database, res)
+		return vectors, nil
+	})
+	pdfText := func(data []byte) (string, error) {
+		res, err := gemini.GenerateContentWithDocument("Extract all of the text of this document. Reply with the text only.", "application/pdf", data, geminiClient.Options{})
+		if err != nil {
+			return "", err
+		}
+		bot.RecordIndexUsage(database, res)
+		return res.Text, nil
+	}
+
+	index := knowledge.NewIndex(database, embedder, model, pdfText)
+	if err := index.Build(cfg.KnowledgeDocsDir); err != nil {
+		log.Printf("Failed to index knowledge documents in %s: %v", cfg.KnowledgeDocsDir, err)
+	}
+	return index
+}
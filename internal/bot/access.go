@@ -0,0 +1,285 @@
+package bot
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Access modes decide who the bot answers in a chat. In allowlist mode only
+// allowed users are answered, in blocklist mode everyone but blocked users.
+const (
+	accessModeOpen      = "open"
+	accessModeAllowlist = "allowlist"
+	accessModeBlocklist = "blocklist"
+)
+
+var accessModes = []string{accessModeOpen, accessModeAllowlist, accessModeBlocklist}
+
+const (
+	accessRuleAllow = "allow"
+	accessRuleBlock = "block"
+)
+
+// accessNoticeInterval is how often a user who may not use the bot is told
+// so, to avoid answering every message they send.
+const accessNoticeInterval = time.Hour
+
+// noticeLog remembers when users were last sent a notice, so that a user
+// who keeps writing is not answered with the same notice every time.
+type noticeLog struct {
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+// due reports whether the notice key was not sent within interval, and if
+// so records it as sent now.
+func (n *noticeLog) due(key string, interval time.Duration) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.sent == nil {
+		n.sent = make(map[string]time.Time)
+	}
+	if last, ok := n.sent[key]; ok && time.Since(last) < interval {
+		return false
+	}
+	n.sent[key] = time.Now()
+	return true
+}
+
+func isAccessMode(mode string) bool {
+	for _, m := range accessModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// dmAccessScope is the scope of the access rules of private chats, and of
+// the access mode of private chats that have none of their own.
+const dmAccessScope = ""
+
+// accessRuleScope returns the scope the access rules of a chat are stored
+// under: the group JID, or dmAccessScope for every private chat, since the
+// only user of a private chat is the one the rule is about.
+func accessRuleScope(chatJID types.JID, isGroup bool) string {
+	if isGroup {
+		return chatJID.String()
+	}
+	return dmAccessScope
+}
+
+// accessModeScopes returns the scopes the access mode of a chat is looked up
+// in, in order: the group JID, or for a private chat the chat JID under each
+// address of the user known by ids and then dmAccessScope.
+func accessModeScopes(ids []string, chatJID types.JID, isGroup bool) []string {
+	if isGroup {
+		return []string{chatJID.String()}
+	}
+	scopes := []string{chatJID.String()}
+	for _, id := range ids {
+		if scope := dmChatScope(id); scope != scopes[0] {
+			scopes = append(scopes, scope)
+		}
+	}
+	return append(scopes, dmAccessScope)
+}
+
+// dmChatScope returns the scope of the private chat with user.
+func dmChatScope(user string) string {
+	return types.NewJID(user, types.DefaultUserServer).String()
+}
+
+// accessMode returns the access mode of the first of scopes that has one,
+// falling back to ACCESS_MODE and then to open.
+func (h *BotHandler) accessMode(scopes ...string) string {
+	for _, scope := range scopes {
+		if mode := h.DB.GetAccessMode(scope); mode != "" {
+			return mode
+		}
+	}
+	if mode := h.settings().AccessMode; isAccessMode(mode) {
+		return mode
+	}
+	return accessModeOpen
+}
+
+// hasAccess reports whether the user known by ids may use the bot in
+// chatJID. Admins always may, so they cannot lock themselves out.
+func (h *BotHandler) hasAccess(ids []string, chatJID types.JID, isGroup bool) bool {
+	mode := h.accessMode(accessModeScopes(ids, chatJID, isGroup)...)
+	if mode == accessModeOpen {
+		return true
+	}
+
+	scope := accessRuleScope(chatJID, isGroup)
+	var rule string
+	for _, id := range ids {
+		if rule = h.DB.GetAccessRule(scope, id); rule != "" {
+			break
+		}
+	}
+	switch {
+	case mode == accessModeAllowlist && rule == accessRuleAllow:
+		return true
+	case mode == accessModeBlocklist && rule != accessRuleBlock:
+		return true
+	}
+	return h.roleOf(ids, chatJID, isGroup) >= RoleAdmin
+}
+
+// sendAccessDenied tells a user in a private chat that they may not use the
+// bot, at most once per accessNoticeInterval.
+func (h *BotHandler) sendAccessDenied(senderJID string, chatJID types.JID, localizer *goi18n.Localizer) {
+	if !h.settings().AccessDeniedNotice {
+		return
+	}
+
+	if h.notices.due("access:"+senderJID, accessNoticeInterval) {
+		msg, _ := localizer.Localize(&goi18n.LocalizeConfig{MessageID: "access_denied"})
+		h.sendMessage(chatJID, msg)
+	}
+}
+
+// handleAccessCommand manages who the bot answers. In a group it changes the
+// group. In a private chat it changes the default of every private chat, or
+// with a number after the mode, the private chat with that number.
+func (h *BotHandler) handleAccessCommand(cmd *CommandContext) {
+	action := strings.ToLower(cmd.Arg(0))
+	value := strings.ToLower(cmd.Arg(1))
+	scope := accessRuleScope(cmd.ChatJID, cmd.IsGroup)
+
+	switch action {
+	case "", "list":
+		modeScope, ok := h.accessCommandChat(cmd, cmd.Arg(1))
+		if !ok {
+			return
+		}
+		h.sendAccessList(cmd, scope, modeScope)
+	case "mode":
+		if !isAccessMode(value) && value != "default" {
+			h.sendAccessUsage(cmd)
+			return
+		}
+		modeScope, ok := h.accessCommandChat(cmd, cmd.Arg(2))
+		if !ok {
+			return
+		}
+		mode := value
+		if value == "default" {
+			mode = ""
+		}
+		if err := h.DB.SetAccessMode(modeScope, mode); err != nil {
+			h.sendAccessReply(cmd, "settings_save_failed", nil)
+			return
+		}
+		if modeScope != scope {
+			h.sendAccessReply(cmd, "access_chat_mode_updated", map[string]string{"Mode": value, "User": normalizeUser(modeScope)})
+		} else {
+			h.sendAccessReply(cmd, "access_mode_updated", map[string]string{"Mode": value})
+		}
+		log.Printf("Access mode for %q set to %s by %s", modeScope, value, cmd.SenderJID)
+	case accessRuleAllow, accessRuleBlock, "remove":
+		user := normalizeUser(cmd.Arg(1))
+		if user == "" {
+			h.sendAccessReply(cmd, "role_invalid_user", map[string]string{"User": cmd.Arg(1)})
+			return
+		}
+		if action == "remove" {
+			err := h.DB.DeleteAccessRule(scope, user)
+			if err == sql.ErrNoRows {
+				h.sendAccessReply(cmd, "access_rule_not_found", map[string]string{"User": user})
+				return
+			}
+			if err != nil {
+				h.sendAccessReply(cmd, "settings_save_failed", nil)
+				return
+			}
+			h.sendAccessReply(cmd, "access_rule_removed", map[string]string{"User": user})
+			log.Printf("Access rule for %s in %q removed by %s", user, scope, cmd.SenderJID)
+			return
+		}
+
+		addedBy := ""
+		if ids := commandSenderIDs(cmd); len(ids) > 0 {
+			addedBy = ids[0]
+		}
+		if err := h.DB.SetAccessRule(scope, user, action, addedBy); err != nil {
+			h.sendAccessReply(cmd, "settings_save_failed", nil)
+			return
+		}
+		messageID := "access_user_allowed"
+		if action == accessRuleBlock {
+			messageID = "access_user_blocked"
+		}
+		h.sendAccessReply(cmd, messageID, map[string]string{"User": user})
+		log.Printf("%s set %s rule for %s in %q", cmd.SenderJID, action, user, scope)
+	default:
+		h.sendAccessUsage(cmd)
+	}
+}
+
+// accessCommandChat returns the scope whose access mode /access reads or
+// changes: the rule scope of the chat, or in a private chat the chat with
+// number when it is given. It tells the sender when number is invalid.
+func (h *BotHandler) accessCommandChat(cmd *CommandContext, number string) (string, bool) {
+	scope := accessRuleScope(cmd.ChatJID, cmd.IsGroup)
+	if number == "" || cmd.IsGroup {
+		return scope, true
+	}
+	user := normalizeUser(number)
+	if user == "" {
+		h.sendAccessReply(cmd, "role_invalid_user", map[string]string{"User": number})
+		return "", false
+	}
+	return dmChatScope(user), true
+}
+
+// sendAccessList shows the rules of scope and the access mode of modeScope.
+func (h *BotHandler) sendAccessList(cmd *CommandContext, scope, modeScope string) {
+	rules, err := h.DB.ListAccessRules(scope)
+	if err != nil {
+		log.Printf("Failed to list access rules for %q: %v", scope, err)
+	}
+
+	var allowed, blocked []string
+	for _, r := range rules {
+		if r.Rule == accessRuleBlock {
+			blocked = append(blocked, r.JID)
+		} else {
+			allowed = append(allowed, r.JID)
+		}
+	}
+	list := func(users []string) string {
+		if len(users) == 0 {
+			return "-"
+		}
+		return strings.Join(users, ", ")
+	}
+
+	h.sendAccessReply(cmd, "access_current", map[string]string{
+		"Mode":    h.accessMode(modeScope, scope),
+		"Modes":   strings.Join(accessModes, ", "),
+		"Allowed": list(allowed),
+		"Blocked": list(blocked),
+	})
+}
+
+func (h *BotHandler) sendAccessReply(cmd *CommandContext, messageID string, data map[string]string) {
+	msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+		MessageID:    messageID,
+		TemplateData: data,
+	})
+	h.sendMessage(cmd.ChatJID, msg)
+}
+
+func (h *BotHandler) sendAccessUsage(cmd *CommandContext) {
+	msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "access_usage"})
+	h.sendMessage(cmd.ChatJID, msg)
+}
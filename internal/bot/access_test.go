@@ -0,0 +1,60 @@
+package bot
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gemini-whatsapp-bot/internal/db"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestHasAccessPerPrivateChat(t *testing.T) {
+	database := db.New(filepath.Join(t.TempDir(), "bot.db"))
+	t.Cleanup(func() { database.Close() })
+	database.InitSchema()
+	h := &BotHandler{DB: database}
+	h.SetSettings(&Settings{AccessMode: accessModeOpen})
+
+	ann := types.NewJID("6281111111111", types.DefaultUserServer)
+	bob := types.NewJID("6282222222222", types.DefaultUserServer)
+	annLID := types.NewJID("123456789", types.HiddenUserServer)
+	access := func(chat types.JID, ids ...string) bool {
+		return h.hasAccess(ids, chat, false)
+	}
+
+	if err := database.SetAccessMode(dmAccessScope, accessModeAllowlist); err != nil {
+		t.Fatal(err)
+	}
+	if access(ann, ann.User) || access(bob, bob.User) {
+		t.Fatal("allowlist default let an unlisted user in")
+	}
+
+	// A mode set for Ann's chat overrides the default for her only, also
+	// when she writes from her LID.
+	if err := database.SetAccessMode(dmChatScope(ann.User), accessModeOpen); err != nil {
+		t.Fatal(err)
+	}
+	if !access(ann, ann.User) || !access(annLID, annLID.User, ann.User) {
+		t.Error("Ann was refused in her open chat")
+	}
+	if access(bob, bob.User) {
+		t.Error("Bob got in through Ann's chat mode")
+	}
+
+	// Rules of private chats stay shared, so an allowed user gets in under
+	// the default mode.
+	if err := database.SetAccessRule(dmAccessScope, bob.User, accessRuleAllow, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !access(bob, bob.User) {
+		t.Error("allowed Bob was refused")
+	}
+
+	if err := database.SetAccessMode(dmChatScope(ann.User), ""); err != nil {
+		t.Fatal(err)
+	}
+	if access(ann, ann.User) {
+		t.Error("Ann kept access after her chat mode was reset to the default")
+	}
+}
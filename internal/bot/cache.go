@@ -0,0 +1,172 @@
+package bot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	geminiClient "gemini-whatsapp-bot/pkg/gemini"
+
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// cacheContextWindow is how recent the last message of a chat may be for a
+// question to still count as part of an ongoing conversation. Such questions
+// may depend on what was said before, so they are never answered from the
+// response cache.
+const cacheContextWindow = 10 * time.Minute
+
+// cacheStats counts how the response cache was used since the bot started.
+type cacheStats struct {
+	hits     atomic.Int64
+	misses   atomic.Int64
+	bypassed atomic.Int64
+}
+
+// normalizePrompt folds case, whitespace and trailing punctuation so that
+// "Opening hours?" and "opening  hours" share a cache entry.
+func normalizePrompt(prompt string) string {
+	prompt = strings.ToLower(strings.Join(strings.Fields(prompt), " "))
+	return strings.TrimRight(prompt, "?!.,;: ")
+}
+
+// responseCacheKey returns the key the reply to turn is cached under, or an
+// empty string when the cache is disabled or turn must not be answered from
+// it: it carries media, a quote or special instructions, the sender has a
+// conversation in progress, or the knowledge reads fields that differ per
+// sender or per minute. The key covers the knowledge or persona in effect
+// and the retrieved passages, but not who asked, so customers asking the same
+// question share a reply.
+func (h *BotHandler) responseCacheKey(turn userTurn, chatJID types.JID, senderJID, historyJID, userName, passages string, opts geminiClient.Options) string {
+	if h.settings().ResponseCacheTTL <= 0 {
+		return ""
+	}
+	// In a group only the sender's own recent messages make the question a
+	// follow-up; the rest of the group is talking about other things.
+	speaker := ""
+	if chatJID.Server == types.GroupServer {
+		speaker = userName
+	}
+	prompt := normalizePrompt(turn.Prompt)
+	if prompt == "" || turn.Media != nil || turn.Quote != nil || len(turn.Instructions) > 0 || turn.SpokenReply ||
+		h.DB.HasRecentHistory(historyJID, speaker, cacheContextWindow) {
+		h.cache.bypassed.Add(1)
+		return ""
+	}
+	version, ok := h.instructionVersion(chatJID, senderJID, historyJID)
+	if !ok {
+		h.cache.bypassed.Add(1)
+		return ""
+	}
+
+	model := opts.Model
+	if model == "" {
+		model = h.Gemini.DefaultModel()
+	}
+	key := strings.Join([]string{prompt, version, passages, model, h.chatLanguage(senderJID, historyJID)}, "\x00")
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// instructionVersion identifies the knowledge or persona that makes up the
+// system instruction of historyJID. It reports false when the knowledge
+// reads the sender's name or the time of day, so the instruction is never
+// the same for two requests.
+func (h *BotHandler) instructionVersion(chatJID types.JID, senderJID, historyJID string) (string, bool) {
+	kb, persona := h.chatKnowledge(historyJID)
+	var parts []string
+	if persona != nil {
+		parts = append(parts, "persona", persona.Name, persona.Language)
+	}
+	if kb != nil {
+		version, ok := kb.Version(h.templateData(kb, chatJID, senderJID, historyJID, ""))
+		if !ok {
+			return "", false
+		}
+		parts = append(parts, "knowledge", version)
+	}
+	return strings.Join(parts, "\x00"), true
+}
+
+// cachedResponse returns the cached reply for key and the model that wrote
+// it, counting the lookup in the cache statistics.
+func (h *BotHandler) cachedResponse(key string) (string, string, bool) {
+	response, model, ok := h.DB.GetCachedResponse(key)
+	if ok {
+		h.cache.hits.Add(1)
+	} else {
+		h.cache.misses.Add(1)
+	}
+	return response, model, ok
+}
+
+func (h *BotHandler) handleCacheCommand(cmd *CommandContext) {
+	switch strings.ToLower(cmd.Arg(0)) {
+	case "", "stats":
+		h.sendCacheStats(cmd)
+	case "flush":
+		// The cache is shared by every chat, so a group admin may not
+		// empty it.
+		if !h.requireRole(cmd, RoleOwner) {
+			return
+		}
+		n, err := h.DB.FlushResponseCache()
+		if err != nil {
+			log.Printf("Failed to flush response cache: %v", err)
+			errorMsg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "settings_save_failed"})
+			h.sendMessage(cmd.ChatJID, errorMsg)
+			return
+		}
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID:    "cache_flushed",
+			TemplateData: map[string]int64{"Count": n},
+		})
+		h.sendMessage(cmd.ChatJID, msg)
+		log.Printf("%s flushed %d cached responses", cmd.SenderJID, n)
+	default:
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID:    "command_usage",
+			TemplateData: map[string]string{"Usage": "/cache [stats|flush]"},
+		})
+		h.sendMessage(cmd.ChatJID, msg)
+	}
+}
+
+func (h *BotHandler) sendCacheStats(cmd *CommandContext) {
+	ttl := h.settings().ResponseCacheTTL
+	if ttl <= 0 {
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "cache_disabled"})
+		h.sendMessage(cmd.ChatJID, msg)
+		return
+	}
+
+	entries, served, err := h.DB.ResponseCacheStats()
+	if err != nil {
+		log.Printf("Failed to read response cache stats: %v", err)
+	}
+	hits, misses := h.cache.hits.Load(), h.cache.misses.Load()
+	rate := 0.0
+	if hits+misses > 0 {
+		rate = 100 * float64(hits) / float64(hits+misses)
+	}
+
+	msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+		MessageID: "cache_stats",
+		TemplateData: map[string]string{
+			"TTL":      ttl.String(),
+			"Entries":  strconv.FormatInt(entries, 10),
+			"Served":   strconv.FormatInt(served, 10),
+			"Hits":     strconv.FormatInt(hits, 10),
+			"Misses":   strconv.FormatInt(misses, 10),
+			"Bypassed": strconv.FormatInt(h.cache.bypassed.Load(), 10),
+			"HitRate":  fmt.Sprintf("%.1f", rate),
+		},
+	})
+	h.sendMessage(cmd.ChatJID, msg)
+}
@@ -0,0 +1,83 @@
+package bot
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gemini-whatsapp-bot/internal/db"
+	"gemini-whatsapp-bot/internal/knowledge"
+	geminiClient "gemini-whatsapp-bot/pkg/gemini"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func newCacheTestHandler(t *testing.T, persona string) *BotHandler {
+	t.Helper()
+	database := db.New(filepath.Join(t.TempDir(), "bot.db"))
+	t.Cleanup(func() { database.Close() })
+	database.InitSchema()
+
+	kb, err := (&knowledge.Knowledge{}).WithPersona(persona)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &BotHandler{DB: database}
+	h.SetSettings(&Settings{
+		Knowledge:        kb,
+		KnowledgeEnabled: true,
+		ResponseCacheTTL: time.Hour,
+	})
+	return h
+}
+
+func TestResponseCacheSharedAcrossSenders(t *testing.T) {
+	h := newCacheTestHandler(t, "You are the assistant of a coffee shop open {{.Weekday}}.")
+	opts := geminiClient.Options{Model: "gemini-test"}
+	ann := types.NewJID("6281111111111", types.DefaultUserServer)
+	bob := types.NewJID("6282222222222", types.DefaultUserServer)
+
+	annKey := h.responseCacheKey(userTurn{Prompt: "Opening hours?"}, ann, ann.String(), ann.String(), "Ann", "", opts)
+	if annKey == "" {
+		t.Fatal("question from Ann bypassed the cache")
+	}
+	h.DB.SetCachedResponse(annKey, "We open at 8.", "gemini-test", time.Hour)
+
+	bobKey := h.responseCacheKey(userTurn{Prompt: "opening  hours"}, bob, bob.String(), bob.String(), "Bob", "", opts)
+	response, _, ok := h.cachedResponse(bobKey)
+	if !ok || response != "We open at 8." {
+		t.Fatalf("Bob got %q, %v from the cache, want Ann's reply", response, ok)
+	}
+
+	if key := h.responseCacheKey(userTurn{Prompt: "Opening hours?"}, bob, bob.String(), bob.String(), "Bob", "Opening hours: 8 to 5", opts); key == annKey {
+		t.Error("different retrieved passages share a cache key")
+	}
+}
+
+func TestResponseCacheBypassedForPersonalTemplates(t *testing.T) {
+	h := newCacheTestHandler(t, "You are talking to {{.UserName}}.")
+	ann := types.NewJID("6281111111111", types.DefaultUserServer)
+
+	key := h.responseCacheKey(userTurn{Prompt: "Opening hours?"}, ann, ann.String(), ann.String(), "Ann", "", geminiClient.Options{Model: "gemini-test"})
+	if key != "" {
+		t.Errorf("got key %q for a template that reads the user name, want a bypass", key)
+	}
+}
+
+func TestResponseCacheInActiveGroup(t *testing.T) {
+	h := newCacheTestHandler(t, "You are the assistant of a coffee shop.")
+	group := types.NewJID("120363000000000000", types.GroupServer)
+	opts := geminiClient.Options{Model: "gemini-test"}
+	h.DB.AddMessageToHistory(group.String(), "user", "Anyone up for lunch?", "Ann")
+	h.DB.AddModelReplyToHistory(group.String(), "Enjoy your lunch!", "gemini-test")
+	h.groups.groups = map[types.JID]cachedGroupInfo{
+		group: {info: &types.GroupInfo{GroupName: types.GroupName{Name: "Regulars"}}, fetchedAt: time.Now()},
+	}
+
+	if key := h.responseCacheKey(userTurn{Prompt: "Opening hours?"}, group, "6282222222222@s.whatsapp.net", group.String(), "Bob", "", opts); key == "" {
+		t.Error("Bob bypassed the cache because Ann talked in the group")
+	}
+	if key := h.responseCacheKey(userTurn{Prompt: "Opening hours?"}, group, "6281111111111@s.whatsapp.net", group.String(), "Ann", "", opts); key != "" {
+		t.Error("Ann's follow-up question was answered from the cache")
+	}
+}
@@ -0,0 +1,214 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+)
+
+// DefaultCommands returns a registry with the bot's built-in commands.
+func DefaultCommands() *CommandRegistry {
+	r := NewCommandRegistry()
+	r.Register(&Command{
+		Name:          "help",
+		DescriptionID: "cmd_help_desc",
+		Handler:       (*BotHandler).handleHelpCommand,
+	})
+	r.Register(&Command{
+		Name:          "ask",
+		Aliases:       []string{"ai"},
+		Args:          []CommandArg{{Name: "question", Required: true, Rest: true}},
+		Trigger:       true,
+		DescriptionID: "cmd_ask_desc",
+		Handler:       (*BotHandler).handleAskCommand,
+	})
+	r.Register(&Command{
+		Name:          "lang",
+		Args:          []CommandArg{{Name: "code", Required: true}},
+		DescriptionID: "cmd_lang_desc",
+		Handler:       (*BotHandler).handleLangCommand,
+	})
+	r.Register(&Command{
+		Name:          "reset",
+		Aliases:       []string{"newchat"},
+		GroupRole:     RoleAdmin,
+		DescriptionID: "cmd_reset_desc",
+		Handler:       (*BotHandler).handleResetCommand,
+	})
+	r.Register(&Command{
+		Name:          "location",
+		DescriptionID: "cmd_location_desc",
+		Handler:       (*BotHandler).handleLocationCommand,
+	})
+	r.Register(&Command{
+		Name:          "menu",
+		DescriptionID: "cmd_menu_desc",
+		Handler:       (*BotHandler).handleMenuCommand,
+	})
+	r.Register(&Command{
+		Name:          "keys",
+		Scope:         ScopeDM,
+		Role:          RoleOwner,
+		DescriptionID: "cmd_keys_desc",
+		Handler:       (*BotHandler).handleKeysCommand,
+	})
+	r.Register(&Command{
+		Name:          "model",
+		Args:          []CommandArg{{Name: "name|default"}},
+		Role:          RoleAdmin,
+		DescriptionID: "cmd_model_desc",
+		Handler:       (*BotHandler).handleModelCommand,
+	})
+	r.Register(&Command{
+		Name:          "params",
+		Args:          []CommandArg{{Name: "temperature|top_p|max_tokens", Required: true}, {Name: "value|default", Required: true}},
+		Role:          RoleAdmin,
+		DescriptionID: "cmd_params_desc",
+		Handler:       (*BotHandler).handleParamsCommand,
+	})
+	r.Register(&Command{
+		Name:          "voice",
+		Args:          []CommandArg{{Name: "text|transcribe|voice"}},
+		GroupRole:     RoleAdmin,
+		DescriptionID: "cmd_voice_desc",
+		Handler:       (*BotHandler).handleVoiceCommand,
+	})
+	r.Register(&Command{
+		Name:          "trigger",
+		Args:          []CommandArg{{Name: "command|mention|keyword|all"}},
+		Scope:         ScopeGroup,
+		Role:          RoleAdmin,
+		DescriptionID: "cmd_trigger_desc",
+		Handler:       (*BotHandler).handleTriggerCommand,
+	})
+	r.Register(&Command{
+		Name:          "persona",
+		Args:          []CommandArg{{Name: "list|set|clear|save|option|delete"}, {Name: "args", Rest: true}},
+		Role:          RoleAdmin,
+		DescriptionID: "cmd_persona_desc",
+		Handler:       (*BotHandler).handlePersonaCommand,
+	})
+	r.Register(&Command{
+		Name:          "grant",
+		Args:          []CommandArg{{Name: "number", Required: true}, {Name: "admin|owner"}},
+		Role:          RoleOwner,
+		DescriptionID: "cmd_grant_desc",
+		Handler:       (*BotHandler).handleGrantCommand,
+	})
+	r.Register(&Command{
+		Name:          "revoke",
+		Args:          []CommandArg{{Name: "number", Required: true}},
+		Role:          RoleOwner,
+		DescriptionID: "cmd_revoke_desc",
+		Handler:       (*BotHandler).handleRevokeCommand,
+	})
+	r.Register(&Command{
+		Name:          "roles",
+		Role:          RoleOwner,
+		DescriptionID: "cmd_roles_desc",
+		Handler:       (*BotHandler).handleRolesCommand,
+	})
+	r.Register(&Command{
+		Name:          "access",
+		Args:          []CommandArg{{Name: "list|mode|allow|block|remove"}, {Name: "value"}, {Name: "number"}},
+		Role:          RoleOwner,
+		GroupRole:     RoleAdmin,
+		DescriptionID: "cmd_access_desc",
+		Handler:       (*BotHandler).handleAccessCommand,
+	})
+	r.Register(&Command{
+		Name:          "quota",
+		DescriptionID: "cmd_quota_desc",
+		Handler:       (*BotHandler).handleQuotaCommand,
+	})
+	r.Register(&Command{
+		Name:          "usage",
+		Args:          []CommandArg{{Name: "export|days"}, {Name: "days"}},
+		Role:          RoleOwner,
+		DescriptionID: "cmd_usage_desc",
+		Handler:       (*BotHandler).handleUsageCommand,
+	})
+	r.Register(&Command{
+		Name:          "cache",
+		Args:          []CommandArg{{Name: "stats|flush"}},
+		Role:          RoleAdmin,
+		DescriptionID: "cmd_cache_desc",
+		Handler:       (*BotHandler).handleCacheCommand,
+	})
+	return r
+}
+
+func (h *BotHandler) handleHelpCommand(cmd *CommandContext) {
+	header, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "help_header"})
+
+	role := h.senderRole(cmd)
+	var sb strings.Builder
+	sb.WriteString(header)
+	for _, command := range h.Commands.Commands() {
+		if !command.allowedIn(cmd.IsGroup) || role < command.requiredRole(cmd.IsGroup) {
+			continue
+		}
+		desc, err := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: command.DescriptionID})
+		if err != nil {
+			log.Printf("Missing help description %q: %v", command.DescriptionID, err)
+		}
+		sb.WriteString("\n*" + command.Usage() + "*")
+		for _, alias := range command.Aliases {
+			sb.WriteString(", /" + alias)
+		}
+		if desc != "" {
+			sb.WriteString("\n" + desc)
+		}
+	}
+	h.sendMessage(cmd.ChatJID, sb.String())
+}
+
+func (h *BotHandler) handleAskCommand(cmd *CommandContext) {
+	if !h.admitRequest(cmd.SenderJID, cmd.ChatJID, cmd.Localizer) {
+		return
+	}
+	log.Printf("Received valid prompt from %s: %s", cmd.SenderJID, cmd.Arg(0))
+	h.handleGeminiQuery(cmd.Arg(0), cmd.Quote, cmd.ChatJID, cmd.SenderJID, cmd.HistoryJID, cmd.UserName, cmd.Localizer)
+}
+
+func (h *BotHandler) handleLocationCommand(cmd *CommandContext) {
+	h.sendLocation(cmd.ChatJID, cmd.Localizer)
+}
+
+func (h *BotHandler) handleMenuCommand(cmd *CommandContext) {
+	h.sendMenu(cmd.ChatJID, cmd.Localizer)
+}
+
+func (h *BotHandler) handleKeysCommand(cmd *CommandContext) {
+	header, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "keys_header"})
+
+	var sb strings.Builder
+	sb.WriteString(header)
+	for _, key := range h.Gemini.KeyStats() {
+		var status string
+		switch {
+		case key.Disabled:
+			status, _ = cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "key_status_disabled"})
+		case len(key.Cooldowns) > 0:
+			var cooling []string
+			for model, until := range key.Cooldowns {
+				line, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+					MessageID:    "key_status_cooldown",
+					TemplateData: map[string]string{"Model": model, "Until": until.Format("15:04:05")},
+				})
+				cooling = append(cooling, line)
+			}
+			sort.Strings(cooling)
+			status = strings.Join(cooling, ", ")
+		case !key.Healthy:
+			status, _ = cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "key_status_unhealthy"})
+		default:
+			status, _ = cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "key_status_ok"})
+		}
+		fmt.Fprintf(&sb, "\n#%d %s — %s (✅ %d / ❌ %d)", key.Index, key.MaskedKey, status, key.Successes, key.Failures)
+	}
+	h.sendMessage(cmd.ChatJID, sb.String())
+}
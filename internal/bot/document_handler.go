@@ -2,63 +2,142 @@ package bot
 
 import (
 	"context"
+	"fmt"
 	"log"
-	"strings"
 
 	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/binary/proto"
 	"go.mau.fi/whatsmeow/types"
 )
 
-func (h *BotHandler) handleDocumentMessage(doc *proto.DocumentMessage, chatJID types.JID, senderJID string, historyJID string, isGroup bool, localizer *goi18n.Localizer) {
-	log.Printf("Processing document message from %s", senderJID)
+// incomingFile is a document, video or sticker received from a user.
+type incomingFile struct {
+	Message  whatsmeow.DownloadableMessage
+	Kind     string
+	MIMEType string
+	FileName string
+	Caption  string
+	Length   uint64
+	Quote    *quotedMessage
+	// DefaultPrompt is used when the user sent no caption.
+	DefaultPrompt string
+}
 
-	mimeType := doc.GetMimetype()
-	if mimeType != "application/pdf" {
-		log.Printf("Received non-PDF document from %s with MIME type %s, ignoring", senderJID, mimeType)
-		h.sendMessage(chatJID, "Sorry, I can only process PDF documents at the moment.")
-		return
+// incomingFileOf returns the document, video or sticker m carries, with
+// caption as the prompt for it.
+func incomingFileOf(m *proto.Message, caption string, quote *quotedMessage) (incomingFile, bool) {
+	switch {
+	case m.GetDocumentMessage() != nil:
+		doc := m.GetDocumentMessage()
+		return incomingFile{
+			Message:       doc,
+			Kind:          "document",
+			MIMEType:      doc.GetMimetype(),
+			FileName:      doc.GetFileName(),
+			Caption:       caption,
+			Length:        doc.GetFileLength(),
+			Quote:         quote,
+			DefaultPrompt: "Please summarize this document.",
+		}, true
+	case m.GetVideoMessage() != nil:
+		video := m.GetVideoMessage()
+		return incomingFile{
+			Message:       video,
+			Kind:          "video",
+			MIMEType:      video.GetMimetype(),
+			Caption:       caption,
+			Length:        video.GetFileLength(),
+			Quote:         quote,
+			DefaultPrompt: "Please describe what happens in this video.",
+		}, true
+	case m.GetStickerMessage() != nil:
+		sticker := m.GetStickerMessage()
+		return incomingFile{
+			Message:       sticker,
+			Kind:          "sticker",
+			MIMEType:      sticker.GetMimetype(),
+			Length:        sticker.GetFileLength(),
+			Quote:         quote,
+			DefaultPrompt: "React briefly to this sticker in the context of the conversation.",
+		}, true
 	}
+	return incomingFile{}, false
+}
 
-	userCaption := doc.GetCaption()
-
-	if isGroup {
-		if !strings.HasPrefix(userCaption, "/ask") && !strings.HasPrefix(userCaption, "/ai") {
-			log.Printf("Document in group from %s without trigger, ignoring", senderJID)
-			return
-		}
-		if strings.HasPrefix(userCaption, "/ask ") {
-			userCaption = strings.TrimSpace(strings.TrimPrefix(userCaption, "/ask "))
-		} else if strings.HasPrefix(userCaption, "/ai ") {
-			userCaption = strings.TrimSpace(strings.TrimPrefix(userCaption, "/ai "))
-		}
+// acceptFile looks up the capabilities for file and reports whether Gemini
+// can take it. Unsupported and oversized files are rejected with a message
+// to the sender before they count against any limit.
+func (h *BotHandler) acceptFile(file incomingFile, chatJID types.JID, senderJID string, localizer *goi18n.Localizer) (mediaType, string, bool) {
+	mt, mimeType, ok := lookupMediaType(file.MIMEType, file.FileName)
+	if !ok {
+		log.Printf("Received unsupported %s from %s with MIME type %s, ignoring", file.Kind, senderJID, file.MIMEType)
+		msg, _ := localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID:    "document_unsupported",
+			TemplateData: map[string]string{"Types": supportedMediaNames()},
+		})
+		h.sendMessage(chatJID, msg)
+		return mediaType{}, "", false
+	}
+	if file.Length > maxInlineMediaBytes {
+		log.Printf("Received %s of %d bytes from %s, too large", file.Kind, file.Length, senderJID)
+		msg, _ := localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID:    "document_too_large",
+			TemplateData: map[string]int{"MaxMB": maxInlineMediaBytes >> 20},
+		})
+		h.sendMessage(chatJID, msg)
+		return mediaType{}, "", false
 	}
-	
-	h.Client.SendChatPresence(chatJID, types.ChatPresenceComposing, types.ChatPresenceMediaText)
-	defer h.Client.SendChatPresence(chatJID, types.ChatPresencePaused, types.ChatPresenceMediaText)
+	return mt, mimeType, true
+}
+
+func (h *BotHandler) handleFileMessage(file incomingFile, mt mediaType, mimeType string, chatJID types.JID, senderJID string, historyJID string, userName string, localizer *goi18n.Localizer) {
+	log.Printf("Processing %s message from %s", file.Kind, senderJID)
+
+	h.runQueued(chatJID, localizer, func() {
+		h.analyzeFile(file, mt, mimeType, file.Caption, chatJID, senderJID, historyJID, userName, localizer)
+	})
+}
 
-	pdfData, err := h.Client.Download(context.Background(), doc)
+func (h *BotHandler) analyzeFile(file incomingFile, mt mediaType, mimeType string, userCaption string, chatJID types.JID, senderJID string, historyJID string, userName string, localizer *goi18n.Localizer) {
+	data, err := h.whatsApp().Download(context.Background(), file.Message)
 	if err != nil {
-		log.Printf("Failed to download document from %s: %v", senderJID, err)
+		log.Printf("Failed to download %s from %s: %v", file.Kind, senderJID, err)
 		return
 	}
 
+	if mt.Convert != nil {
+		text, err := mt.Convert(data)
+		if err != nil {
+			log.Printf("Failed to convert %s %s from %s: %v", mt.Name, file.FileName, senderJID, err)
+			msg, _ := localizer.Localize(&goi18n.LocalizeConfig{
+				MessageID:    "document_convert_failed",
+				TemplateData: map[string]string{"Type": mt.Name},
+			})
+			h.sendMessage(chatJID, msg)
+			return
+		}
+		data, mimeType = []byte(text), "text/plain"
+	}
+
 	if userCaption == "" {
-		userCaption = "Please summarize this document."
+		userCaption = file.DefaultPrompt
 	}
-	userName := ""
 
-	response, err := h.Gemini.GenerateContentWithDocument(userCaption, mimeType, pdfData)
+	media, err := h.saveMedia(data, mimeType)
 	if err != nil {
-		log.Printf("Error from Gemini Document API for user %s: %v", senderJID, err)
-		errorMsg, _ := localizer.Localize(&goi18n.LocalizeConfig{MessageID: "error_gemini"})
-		h.sendMessage(chatJID, errorMsg)
-		return
+		log.Printf("Failed to store %s from %s: %v", file.Kind, senderJID, err)
+		media = &storedMedia{MIMEType: mimeType, Data: data}
 	}
 
-	log.Printf("Received document response from Gemini for %s, sending reply", senderJID)
-	h.sendMessage(chatJID, response)
-
-	h.DB.AddMessageToHistory(historyJID, "user", "[User sent a PDF] "+userCaption, userName)
-	h.DB.AddMessageToHistory(historyJID, "model", response, "")
-}
\ No newline at end of file
+	label := file.Kind
+	if file.FileName != "" {
+		label += ": " + file.FileName
+	}
+	h.answerTurn(userTurn{
+		Prompt:      userCaption,
+		HistoryText: fmt.Sprintf("[User sent a %s] %s", label, userCaption),
+		Media:       media,
+		Quote:       file.Quote,
+	}, chatJID, senderJID, historyJID, userName, localizer)
+}
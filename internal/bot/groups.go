@@ -0,0 +1,58 @@
+package bot
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// groupInfoTTL is how long fetched group metadata is reused before asking
+// WhatsApp again.
+const groupInfoTTL = 10 * time.Minute
+
+type cachedGroupInfo struct {
+	info      *types.GroupInfo
+	fetchedAt time.Time
+}
+
+// groupCache keeps recently fetched group metadata so that every message in
+// a busy group does not cost a round trip to WhatsApp.
+type groupCache struct {
+	mu     sync.Mutex
+	groups map[types.JID]cachedGroupInfo
+}
+
+func (h *BotHandler) groupInfo(chatJID types.JID) (*types.GroupInfo, error) {
+	h.groups.mu.Lock()
+	if h.groups.groups == nil {
+		h.groups.groups = make(map[types.JID]cachedGroupInfo)
+	}
+	cached, ok := h.groups.groups[chatJID]
+	h.groups.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < groupInfoTTL {
+		return cached.info, nil
+	}
+
+	info, err := h.whatsApp().GetGroupInfo(chatJID)
+	if err != nil {
+		return nil, err
+	}
+
+	h.groups.mu.Lock()
+	h.groups.groups[chatJID] = cachedGroupInfo{info: info, fetchedAt: time.Now()}
+	h.groups.mu.Unlock()
+	return info, nil
+}
+
+// groupName returns the subject of a group chat, or an empty string if it
+// cannot be fetched.
+func (h *BotHandler) groupName(chatJID types.JID) string {
+	info, err := h.groupInfo(chatJID)
+	if err != nil {
+		log.Printf("Failed to get group info for %s: %v", chatJID, err)
+		return ""
+	}
+	return info.Name
+}
@@ -9,7 +9,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/generative-ai-go/genai"
@@ -20,16 +22,66 @@ import (
 	"go.mau.fi/whatsmeow/types/events"
 )
 
+var supportedLanguages = []string{"en", "id"}
+
+func isSupportedLanguage(lang string) bool {
+	for _, supported := range supportedLanguages {
+		if lang == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// Generator is the part of the Gemini client the bot calls.
+// *geminiClient.Client implements it.
+type Generator interface {
+	DefaultModel() string
+	GenerateContentWithTools(history []*genai.Content, tools *geminiClient.ToolRegistry, opts geminiClient.Options) (*geminiClient.Result, error)
+	GenerateContentStream(history []*genai.Content, tools *geminiClient.ToolRegistry, opts geminiClient.Options, onChunk geminiClient.StreamFunc) (*geminiClient.Result, error)
+	GenerateContentWithMedia(prompt string, mimeType string, data []byte, opts geminiClient.Options) (*geminiClient.Result, error)
+	KeyStats() []geminiClient.KeyStats
+}
+
+// messenger is the part of the WhatsApp client that sends, edits and
+// downloads messages. *whatsmeow.Client implements it.
+type messenger interface {
+	SendMessage(ctx context.Context, to types.JID, message *proto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error)
+	BuildEdit(chat types.JID, id types.MessageID, newContent *proto.Message) *proto.Message
+	SendChatPresence(jid types.JID, state types.ChatPresence, media types.ChatPresenceMedia) error
+	Download(ctx context.Context, msg whatsmeow.DownloadableMessage) ([]byte, error)
+	Upload(ctx context.Context, plaintext []byte, appInfo whatsmeow.MediaType) (whatsmeow.UploadResponse, error)
+	GetGroupInfo(jid types.JID) (*types.GroupInfo, error)
+}
+
 type BotHandler struct {
-	Client *whatsmeow.Client
-	DB     *db.Database
-	Bundle *goi18n.Bundle
-	Gemini *geminiClient.Client
-	Knowledge        *knowledge.Knowledge
-	KnowledgeEnabled bool
-	StoreLatitude    float64
-	StoreLongitude   float64
-	MenuImagePath    string
+	Client    *whatsmeow.Client
+	DB        *db.Database
+	Gemini    Generator
+	Retriever *knowledge.Index
+	Queue     *ChatQueue
+	Commands  *CommandRegistry
+	MediaDir  string
+	// SenderLimiter and ChatLimiter throttle requests to Gemini per sender
+	// and per chat. A nil limiter allows everything.
+	SenderLimiter *RateLimiter
+	ChatLimiter   *RateLimiter
+
+	// wa replaces Client for sending and downloading when set.
+	wa messenger
+
+	current atomic.Pointer[Settings]
+	groups  groupCache
+	notices noticeLog
+	cache   cacheStats
+}
+
+// whatsApp returns the client messages are sent and downloaded through.
+func (h *BotHandler) whatsApp() messenger {
+	if h.wa != nil {
+		return h.wa
+	}
+	return h.Client
 }
 
 func (h *BotHandler) EventHandler(evt interface{}) {
@@ -50,8 +102,6 @@ func (h *BotHandler) handleMessage(msg *events.Message) {
 		return
 	}
 
-	userLang := h.DB.GetUserLang(senderJID)
-	localizer := goi18n.NewLocalizer(h.Bundle, userLang)
 	chatJID := msg.Info.Chat
 	isGroup := msg.Info.IsGroup
 
@@ -62,144 +112,146 @@ func (h *BotHandler) handleMessage(msg *events.Message) {
 		historyJID = senderJID
 	}
 
-	if img := msg.Message.GetImageMessage(); img != nil {
-		h.handleImageMessage(img, chatJID, senderJID, historyJID, isGroup, localizer)
-		return
-	}
+	userLang := h.chatLanguage(senderJID, historyJID)
+	localizer := goi18n.NewLocalizer(h.settings().Bundle, userLang)
 
-	if doc := msg.Message.GetDocumentMessage(); doc != nil {
-		h.handleDocumentMessage(doc, chatJID, senderJID, historyJID, isGroup, localizer)
+	if !h.hasAccess(senderIDs(msg), chatJID, isGroup) {
+		log.Printf("Sender %s has no access to %s, ignoring", senderJID, chatJID)
+		if !isGroup {
+			h.sendAccessDenied(senderJID, chatJID, localizer)
+		}
 		return
 	}
 
-	var text string
-	if msg.Message.GetConversation() != "" {
-		text = msg.Message.GetConversation()
-	} else if extMsg := msg.Message.GetExtendedTextMessage(); extMsg != nil {
-		text = extMsg.GetText()
+	ci := messageContextInfo(msg.Message)
+	quote := h.quotedMessage(ci)
+	text := strings.TrimSpace(messageText(msg.Message))
+
+	if msg.Message.GetConversation() != "" || msg.Message.GetExtendedTextMessage() != nil {
+		cmd := &CommandContext{
+			Msg:        msg,
+			ChatJID:    chatJID,
+			SenderJID:  senderJID,
+			HistoryJID: historyJID,
+			IsGroup:    isGroup,
+			UserName:   userName,
+			Quote:      quote,
+			Localizer:  localizer,
+		}
+		if h.dispatchCommand(text, cmd) {
+			return
+		}
 	}
 
-	if text == "" {
-		log.Println("Could not extract any valid text from the message, ignoring")
+	prompt, triggered := h.triggerPrompt(text, ci, quote, historyJID, isGroup)
+	if !triggered {
+		log.Printf("Message in group from %s without trigger, ignoring", senderJID)
 		return
 	}
 
-	cleanedText := strings.TrimSpace(text)
-
-	if strings.HasPrefix(cleanedText, "/lang") {
-		h.handleLangCommand(cleanedText, senderJID, localizer)
-		return
-	}
-	if cleanedText == "/reset" || cleanedText == "/newchat" {
-		h.handleResetCommand(historyJID, chatJID)
+	m := msg.Message
+	hasMedia := m.GetImageMessage() != nil || m.GetDocumentMessage() != nil || m.GetVideoMessage() != nil ||
+		m.GetStickerMessage() != nil || m.GetAudioMessage() != nil
+	if prompt == "" && !hasMedia {
+		log.Println("Could not extract any valid text from the message, ignoring")
 		return
 	}
-
-	var prompt string
-	shouldRespond := false
-
-	if !isGroup {
-		prompt = cleanedText
-		shouldRespond = true
-	} else {
-		if strings.HasPrefix(cleanedText, "/ask ") {
-			prompt = strings.TrimSpace(strings.TrimPrefix(cleanedText, "/ask "))
-			shouldRespond = true
-		} else if strings.HasPrefix(cleanedText, "/ai ") {
-			prompt = strings.TrimSpace(strings.TrimPrefix(cleanedText, "/ai "))
-			shouldRespond = true
+	file, isFile := incomingFileOf(m, prompt, quote)
+	var fileType mediaType
+	var fileMIME string
+	if isFile {
+		var ok bool
+		if fileType, fileMIME, ok = h.acceptFile(file, chatJID, senderJID, localizer); !ok {
+			return
 		}
 	}
+	if !h.admitRequest(senderJID, chatJID, localizer) {
+		return
+	}
 
-	if shouldRespond && prompt != "" {
+	switch {
+	case msg.Message.GetImageMessage() != nil:
+		h.handleImageMessage(msg.Message.GetImageMessage(), prompt, quote, chatJID, senderJID, historyJID, userName, localizer)
+	case isFile:
+		h.handleFileMessage(file, fileType, fileMIME, chatJID, senderJID, historyJID, userName, localizer)
+	case msg.Message.GetAudioMessage() != nil:
+		h.handleAudioMessage(msg.Message.GetAudioMessage(), quote, chatJID, senderJID, historyJID, userName, localizer)
+	default:
 		log.Printf("Received valid prompt from %s: %s", senderJID, prompt)
-		h.handleGeminiQuery(prompt, chatJID, historyJID, userName, localizer)
-	} else if isGroup {
-		log.Printf("Message in group from %s without trigger, ignoring", senderJID)
+		h.handleGeminiQuery(prompt, quote, chatJID, senderJID, historyJID, userName, localizer)
 	}
 }
 
-func (h *BotHandler) handleImageMessage(img *proto.ImageMessage, chatJID types.JID, senderJID string, historyJID string, isGroup bool, localizer *goi18n.Localizer) {
+func (h *BotHandler) handleImageMessage(img *proto.ImageMessage, userCaption string, quote *quotedMessage, chatJID types.JID, senderJID string, historyJID string, userName string, localizer *goi18n.Localizer) {
 	log.Printf("Processing image message from %s", senderJID)
-	
-	userCaption := img.GetCaption()
 
-	if isGroup {
-		if !strings.HasPrefix(userCaption, "/ask") && !strings.HasPrefix(userCaption, "/ai") {
-			log.Printf("Image in group from %s without trigger, ignoring", senderJID)
-			return
-		}
-		if strings.HasPrefix(userCaption, "/ask ") {
-			userCaption = strings.TrimSpace(strings.TrimPrefix(userCaption, "/ask "))
-		} else if strings.HasPrefix(userCaption, "/ai ") {
-			userCaption = strings.TrimSpace(strings.TrimPrefix(userCaption, "/ai "))
-		}
-	}
-	
-	h.Client.SendChatPresence(chatJID, types.ChatPresenceComposing, types.ChatPresenceMediaText)
-	defer h.Client.SendChatPresence(chatJID, types.ChatPresencePaused, types.ChatPresenceMediaText)
+	h.runQueued(chatJID, localizer, func() {
+		h.analyzeImage(img, userCaption, quote, chatJID, senderJID, historyJID, userName, localizer)
+	})
+}
 
-	imageData, err := h.Client.Download(context.Background(), img)
+func (h *BotHandler) analyzeImage(img *proto.ImageMessage, userCaption string, quote *quotedMessage, chatJID types.JID, senderJID string, historyJID string, userName string, localizer *goi18n.Localizer) {
+	imageData, err := h.whatsApp().Download(context.Background(), img)
 	if err != nil {
 		log.Printf("Failed to download image from %s: %v", senderJID, err)
 		return
 	}
 
-	userName := ""
 	if userCaption == "" {
 		userCaption = "Tolong jelaskan gambar ini dan hubungkan dengan produk yang mungkin Anda jual."
 	}
 
 	imageAnalysisInstruction := "Anda adalah asisten AI yang bisa menganalisis gambar. Jelaskan isi gambar yang dikirim oleh pengguna secara detail."
 
-	finalPrompt := userCaption
-	if h.KnowledgeEnabled && h.Knowledge.Content != "" {
-		finalPrompt = fmt.Sprintf("Main Instruction:\n%s\n\nGeneral Personality:\n\"\"\"\n%s\n\"\"\"\n\nUser's Question about the image:\n%s", imageAnalysisInstruction, h.Knowledge.Content, userCaption)
+	mimeType := img.GetMimetype()
+	if !strings.HasPrefix(mimeType, "image/") {
+		log.Printf("Unexpected MIME type format: %s", mimeType)
+		mimeType = "image/jpeg"
 	}
-
-	mimeParts := strings.Split(img.GetMimetype(), "/")
-	var mimeType string
-	if len(mimeParts) == 2 {
-		mimeType = mimeParts[1]
-	} else {
-		log.Printf("Unexpected MIME type format: %s", img.GetMimetype())
-		mimeType = "jpeg"
+	if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+		mimeType = mimeType[:i]
 	}
 
-	response, err := h.Gemini.GenerateContentWithImage(finalPrompt, mimeType, imageData)
+	media, err := h.saveMedia(imageData, mimeType)
 	if err != nil {
-		log.Printf("Error from Gemini Vision API for user %s: %v", senderJID, err)
-		errorMsg, _ := localizer.Localize(&goi18n.LocalizeConfig{MessageID: "error_gemini"})
-		h.sendMessage(chatJID, errorMsg)
-		return
+		log.Printf("Failed to store image from %s: %v", senderJID, err)
+		media = &storedMedia{MIMEType: mimeType, Data: imageData}
 	}
 
-	log.Printf("Received vision response from Gemini for %s, sending reply", senderJID)
-	h.sendMessage(chatJID, response)
-
-	h.DB.AddMessageToHistory(historyJID, "user", "[User sent an image] "+userCaption, userName)
-	h.DB.AddMessageToHistory(historyJID, "model", response, "")
+	h.answerTurn(userTurn{
+		Prompt:       userCaption,
+		HistoryText:  "[User sent an image] " + userCaption,
+		Media:        media,
+		Quote:        quote,
+		Instructions: []string{imageAnalysisInstruction},
+	}, chatJID, senderJID, historyJID, userName, localizer)
 }
 
-
-func (h *BotHandler) sendLocation(recipient types.JID) {
-	if h.StoreLatitude == 0 || h.StoreLongitude == 0 {
+func (h *BotHandler) sendLocation(recipient types.JID, localizer *goi18n.Localizer) {
+	settings := h.settings()
+	if settings.StoreLatitude == 0 || settings.StoreLongitude == 0 {
 		log.Println("Store location is not configured")
-		h.sendMessage(recipient, "Maaf, lokasi toko belum diatur.")
+		msg, _ := localizer.Localize(&goi18n.LocalizeConfig{MessageID: "location_not_configured"})
+		h.sendMessage(recipient, msg)
 		return
 	}
-	
-	lat := h.StoreLatitude
-	lon := h.StoreLongitude
 
-	msg := &proto.Message{
-		LocationMessage: &proto.LocationMessage{
-			DegreesLatitude:  &lat,
-			DegreesLongitude: &lon,
-		},
+	lat := settings.StoreLatitude
+	lon := settings.StoreLongitude
+
+	location := &proto.LocationMessage{
+		DegreesLatitude:  &lat,
+		DegreesLongitude: &lon,
+	}
+	if settings.StoreName != "" {
+		location.Name = &settings.StoreName
 	}
-	
-	_, err := h.Client.SendMessage(context.Background(), recipient, msg)
+	if settings.StoreAddress != "" {
+		location.Address = &settings.StoreAddress
+	}
+	msg := &proto.Message{LocationMessage: location}
+
+	_, err := h.whatsApp().SendMessage(context.Background(), recipient, msg)
 	if err != nil {
 		log.Printf("Failed to send location to %s: %v", recipient, err)
 	} else {
@@ -207,25 +259,49 @@ func (h *BotHandler) sendLocation(recipient types.JID) {
 	}
 }
 
-func (h *BotHandler) sendImage(recipient types.JID, imagePath, caption string) {
-	if imagePath == "" {
-		log.Println("Image path is not configured")
-		h.sendMessage(recipient, "Maaf, file gambar belum diatur.")
+// sendMenu sends every configured menu image followed by the menu PDF.
+func (h *BotHandler) sendMenu(recipient types.JID, localizer *goi18n.Localizer) {
+	settings := h.settings()
+	if len(settings.MenuImagePaths) == 0 && settings.MenuPDFPath == "" {
+		log.Println("Menu is not configured")
+		msg, _ := localizer.Localize(&goi18n.LocalizeConfig{MessageID: "menu_not_configured"})
+		h.sendMessage(recipient, msg)
 		return
 	}
 
+	failed := false
+	for i, path := range settings.MenuImagePaths {
+		caption := ""
+		if i == 0 && settings.StoreName != "" {
+			caption = settings.StoreName
+		}
+		if err := h.sendImage(recipient, path, caption); err != nil {
+			log.Printf("Failed to send menu image %s to %s: %v", path, recipient, err)
+			failed = true
+		}
+	}
+	if settings.MenuPDFPath != "" {
+		if err := h.sendDocument(recipient, settings.MenuPDFPath, "application/pdf"); err != nil {
+			log.Printf("Failed to send menu document %s to %s: %v", settings.MenuPDFPath, recipient, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		msg, _ := localizer.Localize(&goi18n.LocalizeConfig{MessageID: "menu_send_failed"})
+		h.sendMessage(recipient, msg)
+	}
+}
+
+func (h *BotHandler) sendImage(recipient types.JID, imagePath, caption string) error {
 	data, err := os.ReadFile(imagePath)
 	if err != nil {
-		log.Printf("Failed to read image file %s: %v", imagePath, err)
-		h.sendMessage(recipient, "Maaf, terjadi kesalahan saat membaca file gambar.")
-		return
+		return fmt.Errorf("read image: %w", err)
 	}
 
-	uploaded, err := h.Client.Upload(context.Background(), data, whatsmeow.MediaImage)
+	uploaded, err := h.whatsApp().Upload(context.Background(), data, whatsmeow.MediaImage)
 	if err != nil {
-		log.Printf("Failed to upload image: %v", err)
-		h.sendMessage(recipient, "Maaf, terjadi kesalahan saat mengunggah gambar.")
-		return
+		return fmt.Errorf("upload image: %w", err)
 	}
 
 	mimetype := http.DetectContentType(data)
@@ -242,30 +318,68 @@ func (h *BotHandler) sendImage(recipient types.JID, imagePath, caption string) {
 		},
 	}
 
-	_, err = h.Client.SendMessage(context.Background(), recipient, msg)
+	_, err = h.whatsApp().SendMessage(context.Background(), recipient, msg)
 	if err != nil {
-		log.Printf("Failed to send image to %s: %v", recipient, err)
-	} else {
-		log.Printf("Sent image to %s", recipient)
+		return fmt.Errorf("send image: %w", err)
 	}
+	log.Printf("Sent image to %s", recipient)
+	return nil
 }
 
-func (h *BotHandler) handleResetCommand(historyJID string, chatJID types.JID) {
-	err := h.DB.DeleteConversationHistory(historyJID)
-	if err == nil {
-		h.sendMessage(chatJID, "Conversation history has been reset.")
-	} else {
-		h.sendMessage(chatJID, "Failed to reset conversation history.")
+func (h *BotHandler) sendDocument(recipient types.JID, documentPath, mimetype string) error {
+	data, err := os.ReadFile(documentPath)
+	if err != nil {
+		return fmt.Errorf("read document: %w", err)
 	}
+	return h.sendDocumentData(recipient, data, filepath.Base(documentPath), mimetype)
 }
 
+// sendDocumentData sends data as a document named fileName.
+func (h *BotHandler) sendDocumentData(recipient types.JID, data []byte, fileName, mimetype string) error {
+	uploaded, err := h.whatsApp().Upload(context.Background(), data, whatsmeow.MediaDocument)
+	if err != nil {
+		return fmt.Errorf("upload document: %w", err)
+	}
+
+	msg := &proto.Message{
+		DocumentMessage: &proto.DocumentMessage{
+			Title:         &fileName,
+			FileName:      &fileName,
+			Mimetype:      &mimetype,
+			URL:           &uploaded.URL,
+			DirectPath:    &uploaded.DirectPath,
+			MediaKey:      uploaded.MediaKey,
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    &uploaded.FileLength,
+		},
+	}
 
-func (h *BotHandler) handleLangCommand(text, senderJID string, localizer *goi18n.Localizer) {
-	parts := strings.Split(text, " ")
-	if len(parts) < 2 {
-		return
+	_, err = h.whatsApp().SendMessage(context.Background(), recipient, msg)
+	if err != nil {
+		return fmt.Errorf("send document: %w", err)
 	}
-	lang := strings.ToLower(parts[1])
+	log.Printf("Sent document to %s", recipient)
+	return nil
+}
+
+func (h *BotHandler) handleResetCommand(cmd *CommandContext) {
+	media, err := h.DB.GetHistoryMediaPaths(cmd.HistoryJID)
+	if err != nil {
+		log.Printf("Failed to list media of %s: %v", cmd.HistoryJID, err)
+	}
+	err = h.DB.DeleteConversationHistory(cmd.HistoryJID)
+	if err == nil {
+		h.removeUnusedMedia(media)
+		h.sendMessage(cmd.ChatJID, "Conversation history has been reset.")
+	} else {
+		h.sendMessage(cmd.ChatJID, "Failed to reset conversation history.")
+	}
+}
+
+func (h *BotHandler) handleLangCommand(cmd *CommandContext) {
+	lang := strings.ToLower(cmd.Arg(0))
+	senderJID := cmd.SenderJID
 
 	recipientJID, err := types.ParseJID(senderJID)
 	if err != nil {
@@ -273,8 +387,8 @@ func (h *BotHandler) handleLangCommand(text, senderJID string, localizer *goi18n
 		return
 	}
 
-	if lang != "en" && lang != "id" {
-		msg, _ := localizer.Localize(&goi18n.LocalizeConfig{
+	if !isSupportedLanguage(lang) {
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
 			MessageID: "lang_not_found",
 			TemplateData: map[string]string{
 				"Lang": lang,
@@ -290,73 +404,190 @@ func (h *BotHandler) handleLangCommand(text, senderJID string, localizer *goi18n
 		return
 	}
 
-	newLocalizer := goi18n.NewLocalizer(h.Bundle, lang)
+	newLocalizer := goi18n.NewLocalizer(h.settings().Bundle, lang)
 	msg, _ := newLocalizer.Localize(&goi18n.LocalizeConfig{MessageID: "lang_updated"})
 	h.sendMessage(recipientJID, msg)
 	log.Printf("User %s language updated to %s", senderJID, lang)
 }
 
-func (h *BotHandler) handleGeminiQuery(prompt string, chatJID types.JID, historyJID string, userName string, localizer *goi18n.Localizer) {
+func (h *BotHandler) handleGeminiQuery(prompt string, quote *quotedMessage, chatJID types.JID, senderJID string, historyJID string, userName string, localizer *goi18n.Localizer) {
+	h.runQueued(chatJID, localizer, func() {
+		h.queryGemini(prompt, quote, chatJID, senderJID, historyJID, userName, localizer)
+	})
+}
+
+func (h *BotHandler) queryGemini(prompt string, quote *quotedMessage, chatJID types.JID, senderJID string, historyJID string, userName string, localizer *goi18n.Localizer) {
+	h.answerTurn(userTurn{Prompt: prompt, HistoryText: prompt, Quote: quote}, chatJID, senderJID, historyJID, userName, localizer)
+}
+
+// userTurn is a user message to answer. HistoryText is what is stored in the
+// conversation history, and Media, when set, is sent along with Prompt and
+// kept for later turns. Quote is the message the user replied to, if any.
+// SpokenReply asks for the answer as a voice note.
+type userTurn struct {
+	Prompt       string
+	HistoryText  string
+	Media        *storedMedia
+	Quote        *quotedMessage
+	Instructions []string
+	SpokenReply  bool
+}
+
+// answerTurn sends turn to Gemini together with the chat history, replies to
+// the chat and stores both sides of the exchange.
+func (h *BotHandler) answerTurn(turn userTurn, chatJID types.JID, senderJID string, historyJID string, userName string, localizer *goi18n.Localizer) {
 	log.Printf("Forwarding message to Gemini, using history key: %s", historyJID)
 
-	h.Client.SendChatPresence(chatJID, types.ChatPresenceComposing, types.ChatPresenceMediaText)
-	defer h.Client.SendChatPresence(chatJID, types.ChatPresencePaused, types.ChatPresenceMediaText)
+	h.whatsApp().SendChatPresence(chatJID, types.ChatPresenceComposing, types.ChatPresenceMediaText)
+	defer h.whatsApp().SendChatPresence(chatJID, types.ChatPresencePaused, types.ChatPresenceMediaText)
 
-	historyFromDB := h.DB.GetConversationHistory(historyJID)
-	var geminiHistory []*genai.Content
+	if turn.Quote != nil {
+		h.applyQuote(&turn)
+	}
 
-	for _, msg := range historyFromDB {
-		// Untuk peran 'user', tambahkan nama pengguna jika ada, agar AI tahu siapa yang berbicara
-		if msg.Role == "user" && msg.UserName != "" {
-			geminiHistory = append(geminiHistory, &genai.Content{
-				Parts: []genai.Part{genai.Text(fmt.Sprintf("%s: %s", msg.UserName, msg.Message))},
-				Role:  msg.Role,
-			})
-		} else {
-			geminiHistory = append(geminiHistory, &genai.Content{
-				Parts: []genai.Part{genai.Text(msg.Message)},
-				Role:  msg.Role,
-			})
+	opts := h.geminiOptions(historyJID)
+	instructions := append([]string{}, turn.Instructions...)
+	if summary := h.conversationSummary(historyJID); summary != "" {
+		instructions = append(instructions, summary)
+	}
+	passages := h.relevantPassages(turn.Prompt)
+	if passages != "" {
+		instructions = append(instructions, passages)
+	}
+	opts.SystemInstruction = h.systemInstruction(chatJID, senderJID, historyJID, userName, instructions...)
+
+	cacheKey := h.responseCacheKey(turn, chatJID, senderJID, historyJID, userName, passages, opts)
+	if cacheKey != "" {
+		if response, model, ok := h.cachedResponse(cacheKey); ok {
+			log.Printf("Answering %s from the response cache", historyJID)
+			h.sendMessage(chatJID, response)
+			h.DB.AddMessageToHistory(historyJID, "user", turn.HistoryText, userName)
+			h.DB.AddModelReplyToHistory(historyJID, response, model)
+			return
 		}
 	}
 
-	// Tambahkan prompt saat ini dengan nama pengguna
-	currentPromptWithUser := fmt.Sprintf("%s: %s", userName, prompt)
-	// --- PERUBAHAN SELESAI ---
+	geminiHistory := h.chatHistory(historyJID)
 
-	finalPrompt := currentPromptWithUser
-	if h.KnowledgeEnabled && h.Knowledge.Content != "" {
-		knowledgeWithUser := strings.ReplaceAll(h.Knowledge.Content, "{{.UserName}}", userName)
-		knowledgePrompt := fmt.Sprintf("Use this personality to answer:\n\"\"\"\n%s\n\"\"\"\n\nUser's Question: %s", knowledgeWithUser, finalPrompt)
-		finalPrompt = knowledgePrompt
+	// Tambahkan prompt saat ini dengan nama pengguna
+	var parts []genai.Part
+	if turn.Media != nil {
+		parts = append(parts, genai.Blob{MIMEType: turn.Media.MIMEType, Data: turn.Media.Data})
 	}
-
+	parts = append(parts, genai.Text(fmt.Sprintf("%s: %s", userName, turn.Prompt)))
 	geminiHistory = append(geminiHistory, &genai.Content{
-		Parts: []genai.Part{genai.Text(finalPrompt)},
+		Parts: parts,
 		Role:  "user",
 	})
 
-	response, err := h.Gemini.GenerateContent(geminiHistory)
-	if err != nil {
-		log.Printf("Error from Gemini API for user %s: %v", historyJID, err)
-		errorMsg, _ := localizer.Localize(&goi18n.LocalizeConfig{MessageID: "error_gemini"})
-		h.sendMessage(chatJID, errorMsg)
-		return
+	tools := h.geminiTools(chatJID, senderJID, localizer)
+
+	var result *geminiClient.Result
+	var err error
+	synth := h.settings().TTS
+	spoken := turn.SpokenReply && synth != nil
+	if h.settings().StreamReplies && !spoken {
+		placeholder, _ := localizer.Localize(&goi18n.LocalizeConfig{MessageID: "processing"})
+		reply := h.newStreamReply(chatJID, placeholder)
+		result, err = h.Gemini.GenerateContentStream(geminiHistory, tools, opts, reply.update)
+		if err != nil {
+			log.Printf("Error from Gemini API for user %s: %v", historyJID, err)
+			errorMsg, _ := localizer.Localize(&goi18n.LocalizeConfig{MessageID: "error_gemini"})
+			reply.finish(errorMsg)
+			return
+		}
+		reply.finish(result.Text)
+	} else {
+		result, err = h.Gemini.GenerateContentWithTools(geminiHistory, tools, opts)
+		if err != nil {
+			log.Printf("Error from Gemini API for user %s: %v", historyJID, err)
+			errorMsg, _ := localizer.Localize(&goi18n.LocalizeConfig{MessageID: "error_gemini"})
+			h.sendMessage(chatJID, errorMsg)
+			return
+		}
+		if spoken {
+			h.sendSpokenReply(synth, chatJID, result.Text, h.chatLanguage(senderJID, historyJID))
+		} else {
+			h.sendMessage(chatJID, result.Text)
+		}
 	}
 
-	log.Printf("Received response from Gemini for %s", historyJID)
-	h.sendMessage(chatJID, response)
+	log.Printf("Received response from Gemini (%s) for %s", result.Model, historyJID)
+	h.recordUsage(chatJID.String(), senderJID, result, contentTokens(geminiHistory)+geminiClient.EstimateTokens(opts.SystemInstruction)+geminiClient.EstimateTokens(result.Text))
 	// Simpan pesan ke database DENGAN nama pengguna
-	h.DB.AddMessageToHistory(historyJID, "user", prompt, userName)
-	h.DB.AddMessageToHistory(historyJID, "model", response, "")
+	if turn.Media != nil && turn.Media.Path != "" {
+		h.DB.AddMediaMessageToHistory(historyJID, turn.HistoryText, userName, turn.Media.Path, turn.Media.MIMEType)
+	} else {
+		h.DB.AddMessageToHistory(historyJID, "user", turn.HistoryText, userName)
+	}
+	h.DB.AddModelReplyToHistory(historyJID, result.Text, result.Model)
+	// A reply that relied on a tool, such as sending the store location,
+	// would be incomplete when replayed, so it is not cached.
+	if cacheKey != "" && !tools.Called() {
+		h.DB.SetCachedResponse(cacheKey, result.Text, result.Model, h.settings().ResponseCacheTTL)
+	}
+	h.compactHistory(historyJID)
+}
+
+// systemInstruction builds the system instruction for a request from any
+// task-specific instructions followed by the knowledge base rendered for the
+// chat. A persona bound to the chat replaces the knowledge base with its own
+// prompt.
+func (h *BotHandler) systemInstruction(chatJID types.JID, senderJID string, historyJID string, userName string, instructions ...string) string {
+	var sections []string
+	sections = append(sections, instructions...)
+
+	kb, persona := h.chatKnowledge(historyJID)
+	if kb != nil {
+		rendered, err := kb.SystemInstruction(h.templateData(kb, chatJID, senderJID, historyJID, userName))
+		if err != nil {
+			log.Printf("Failed to render knowledge for %s: %v", chatJID, err)
+		} else if rendered != "" {
+			sections = append(sections, rendered)
+		}
+	}
+	if persona != nil && persona.Language != "" {
+		sections = append(sections, fmt.Sprintf("Always reply in the language with the code %q.", persona.Language))
+	}
+	return strings.Join(sections, "\n\n")
+}
+
+// chatKnowledge returns the knowledge rendered into the system instruction
+// of historyJID, or nil when there is none, and the persona bound to the
+// chat.
+func (h *BotHandler) chatKnowledge(historyJID string) (*knowledge.Knowledge, *db.Persona) {
+	settings := h.settings()
+	kb, enabled := settings.Knowledge, settings.KnowledgeEnabled
+	persona := h.chatPersona(historyJID)
+	if persona != nil && persona.SystemPrompt != "" {
+		p, err := settings.Knowledge.WithPersona(persona.SystemPrompt)
+		if err != nil {
+			log.Printf("Invalid prompt in persona %s: %v", persona.Name, err)
+		} else {
+			kb, enabled = p, true
+		}
+	}
+	if !enabled || kb.Empty() {
+		return nil, persona
+	}
+	return kb, persona
 }
 
+// templateData returns the data kb is rendered with for a message from
+// senderJID in chatJID.
+func (h *BotHandler) templateData(kb *knowledge.Knowledge, chatJID types.JID, senderJID, historyJID, userName string) knowledge.TemplateData {
+	chatType, groupName := "private", ""
+	if chatJID.Server == types.GroupServer {
+		chatType, groupName = "group", h.groupName(chatJID)
+	}
+	return kb.NewTemplateData(userName, chatType, groupName, h.chatLanguage(senderJID, historyJID))
+}
 
 func (h *BotHandler) sendMessage(recipient types.JID, message string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	_, err := h.Client.SendMessage(ctx, recipient, &proto.Message{
+	_, err := h.whatsApp().SendMessage(ctx, recipient, &proto.Message{
 		Conversation: &message,
 	})
 	if err != nil {
@@ -364,4 +595,4 @@ func (h *BotHandler) sendMessage(recipient types.JID, message string) {
 	} else {
 		log.Printf("Sent message to %s", recipient.String())
 	}
-}
\ No newline at end of file
+}
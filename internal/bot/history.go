@@ -0,0 +1,164 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"gemini-whatsapp-bot/internal/db"
+	geminiClient "gemini-whatsapp-bot/pkg/gemini"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// defaultHistoryTokenBudget is used when no budget is configured.
+const defaultHistoryTokenBudget = 8000
+
+const summaryInstruction = `You keep a running summary of a WhatsApp conversation between users and an assistant bot.
+Merge the previous summary with the new messages into one updated summary.
+Keep names, facts, decisions, open questions and user preferences. Drop greetings and small talk.
+Write at most 200 words in the language of the conversation. Reply with the summary only.`
+
+// historyText returns the text of msg as it is sent to Gemini. User messages
+// are prefixed with the sender's name so the model knows who is speaking.
+func historyText(msg db.HistoryMessage) string {
+	if msg.Role == "user" && msg.UserName != "" {
+		return fmt.Sprintf("%s: %s", msg.UserName, msg.Message)
+	}
+	return msg.Message
+}
+
+// messageTokens estimates the tokens msg takes up, including its media.
+func messageTokens(msg db.HistoryMessage) int {
+	tokens := geminiClient.EstimateTokens(historyText(msg))
+	if msg.MediaPath != "" {
+		tokens += mediaTokens(msg.MediaPath, msg.MediaMIME)
+	}
+	return tokens
+}
+
+func (h *BotHandler) historyTokenBudget() int {
+	if budget := h.settings().HistoryTokenBudget; budget > 0 {
+		return budget
+	}
+	return defaultHistoryTokenBudget
+}
+
+// recentHistory returns the unsummarized messages of the chat that can fall
+// within budget. Every message takes at least one token, so no more than
+// budget of them are read.
+func (h *BotHandler) recentHistory(historyJID string, budget int) []db.HistoryMessage {
+	return h.DB.GetConversationHistory(historyJID, budget)
+}
+
+// historyWindow returns the newest messages that fit in budget estimated
+// tokens, oldest first. The window never starts with a model turn.
+func historyWindow(messages []db.HistoryMessage, budget int) []db.HistoryMessage {
+	start := len(messages)
+	used := 0
+	for start > 0 {
+		tokens := messageTokens(messages[start-1])
+		if used+tokens > budget {
+			break
+		}
+		used += tokens
+		start--
+	}
+	for start < len(messages) && messages[start].Role != "user" {
+		start++
+	}
+	return messages[start:]
+}
+
+// chatHistory builds the Gemini history of the chat from the messages that
+// fit in the token budget. Files sent with a message are read back from disk
+// and sent again, so the model can answer follow-up questions about them.
+func (h *BotHandler) chatHistory(historyJID string) []*genai.Content {
+	var history []*genai.Content
+	budget := h.historyTokenBudget()
+	for _, msg := range historyWindow(h.recentHistory(historyJID, budget), budget) {
+		var parts []genai.Part
+		if msg.MediaPath != "" {
+			data, err := os.ReadFile(msg.MediaPath)
+			if err != nil {
+				log.Printf("Could not read media %s from history of %s: %v", msg.MediaPath, historyJID, err)
+			} else {
+				parts = append(parts, genai.Blob{MIMEType: msg.MediaMIME, Data: data})
+			}
+		}
+		parts = append(parts, genai.Text(historyText(msg)))
+		history = append(history, &genai.Content{Parts: parts, Role: msg.Role})
+	}
+	return history
+}
+
+// conversationSummary returns the running summary of the chat formatted
+// for the system instruction, or an empty string if there is none.
+func (h *BotHandler) conversationSummary(historyJID string) string {
+	summary := h.DB.GetConversationSummary(historyJID)
+	if summary == "" {
+		return ""
+	}
+	return "SUMMARY OF THE EARLIER CONVERSATION:\n" + summary
+}
+
+// compactHistory folds the oldest messages of the chat into its running
+// summary once the unsummarized messages exceed the token budget. It keeps
+// about half the budget of recent messages, so the summary is not rewritten
+// on every turn. Messages older than the newest ones recentHistory reads are
+// folded in without being summarized.
+func (h *BotHandler) compactHistory(historyJID string) {
+	budget := h.historyTokenBudget()
+	messages := h.recentHistory(historyJID, budget)
+
+	total := 0
+	for _, msg := range messages {
+		total += messageTokens(msg)
+	}
+	if total <= budget {
+		return
+	}
+
+	cut := 0
+	for cut < len(messages) && total > budget/2 {
+		total -= messageTokens(messages[cut])
+		cut++
+	}
+	overflow := messages[:cut]
+
+	var sb strings.Builder
+	if previous := h.DB.GetConversationSummary(historyJID); previous != "" {
+		sb.WriteString("PREVIOUS SUMMARY:\n" + previous + "\n\n")
+	}
+	sb.WriteString("NEW MESSAGES:")
+	for _, msg := range overflow {
+		speaker := "Assistant"
+		if msg.Role == "user" {
+			speaker = "User"
+		}
+		fmt.Fprintf(&sb, "\n%s: %s", speaker, historyText(msg))
+	}
+
+	result, err := h.Gemini.GenerateContentWithTools([]*genai.Content{genai.NewUserContent(genai.Text(sb.String()))}, nil, geminiClient.Options{
+		SystemInstruction: summaryInstruction,
+	})
+	if err != nil {
+		log.Printf("Failed to summarize history for %s: %v", historyJID, err)
+		return
+	}
+	h.recordUsage(historyJID, "", result, 0)
+
+	if err := h.DB.SetConversationSummary(historyJID, result.Text, overflow[len(overflow)-1].ID); err != nil {
+		return
+	}
+	log.Printf("Summarized %d older messages for %s", len(overflow), historyJID)
+
+	var media []string
+	for _, msg := range overflow {
+		if msg.MediaPath != "" {
+			media = append(media, msg.MediaPath)
+		}
+	}
+	h.removeUnusedMedia(media)
+}
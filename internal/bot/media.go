@@ -0,0 +1,122 @@
+package bot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultMediaDir is used when no media directory is configured.
+const defaultMediaDir = "media"
+
+// storedMedia is a file a user sent, saved on disk so it can be replayed to
+// Gemini with later messages of the conversation.
+type storedMedia struct {
+	Path     string
+	MIMEType string
+	Data     []byte
+}
+
+func (h *BotHandler) mediaDir() string {
+	if h.MediaDir != "" {
+		return h.MediaDir
+	}
+	return defaultMediaDir
+}
+
+// saveMedia writes data to the media directory, named after its hash so the
+// same file sent twice is stored once.
+func (h *BotHandler) saveMedia(data []byte, mimeType string) (*storedMedia, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty media")
+	}
+	dir := h.mediaDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	ext := ".bin"
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		ext = exts[0]
+	}
+	sum := sha256.Sum256(data)
+	path := filepath.Join(dir, hex.EncodeToString(sum[:])+ext)
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			return nil, err
+		}
+	}
+	return &storedMedia{Path: path, MIMEType: mimeType, Data: data}, nil
+}
+
+// removeUnusedMedia deletes the files at paths that no message replayed to
+// Gemini refers to any more. A file is shared by every chat it was sent in,
+// so it is only removed once the last of them has reset or summarized it.
+func (h *BotHandler) removeUnusedMedia(paths []string) {
+	for _, path := range paths {
+		if h.DB.MediaInUse(path) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Failed to remove media %s: %v", path, err)
+			}
+			continue
+		}
+		log.Printf("Removed media %s", path)
+	}
+}
+
+// PruneMedia deletes the files in the media directory that no message
+// replayed to Gemini refers to, such as those of requests that failed before
+// they were stored. It should run before messages are handled.
+func (h *BotHandler) PruneMedia() {
+	dir := h.mediaDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to read media directory %s: %v", dir, err)
+		}
+		return
+	}
+	var paths []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			paths = append(paths, filepath.Join(dir, entry.Name()))
+		}
+	}
+	h.removeUnusedMedia(paths)
+}
+
+// mediaTokens roughly estimates what a stored file costs in the context
+// window: Gemini bills an image as 258 tokens and a document page or a
+// second of video about as much.
+func mediaTokens(path, mimeType string) int {
+	if strings.HasPrefix(mimeType, "image/") {
+		return mediaSizeTokens(0, mimeType)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return mediaSizeTokens(info.Size(), mimeType)
+}
+
+// mediaSizeTokens is mediaTokens for a file of size bytes.
+func mediaSizeTokens(size int64, mimeType string) int {
+	const perImage = 258
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return perImage
+	case strings.HasPrefix(mimeType, "text/"):
+		return int(size / 4)
+	}
+	// Assume about 50 KB per page for documents and per second for video.
+	return perImage * int(1+size/(50*1024))
+}
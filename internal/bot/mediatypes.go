@@ -0,0 +1,124 @@
+package bot
+
+import (
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"gemini-whatsapp-bot/internal/convert"
+)
+
+// maxInlineMediaBytes is the largest file sent to Gemini inline. Requests
+// over 20 MB are rejected by the API.
+const maxInlineMediaBytes = 20 << 20
+
+// mediaType describes how a kind of file reaches Gemini. Types with a nil
+// Convert are sent as they are; the others are converted to plain text
+// first.
+type mediaType struct {
+	// Name is the label shown to users in the list of supported types.
+	Name       string
+	MIMETypes  []string
+	Extensions []string
+	Convert    func(data []byte) (string, error)
+}
+
+// mediaTypes is the capability table for files sent as documents, videos
+// and stickers.
+var mediaTypes = []mediaType{
+	{Name: "PDF", MIMETypes: []string{"application/pdf"}, Extensions: []string{".pdf"}},
+	{Name: "TXT", MIMETypes: []string{"text/plain"}, Extensions: []string{".txt", ".log"}},
+	{Name: "CSV", MIMETypes: []string{"text/csv"}, Extensions: []string{".csv"}},
+	{
+		Name:       "DOCX",
+		MIMETypes:  []string{"application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		Extensions: []string{".docx"},
+		Convert:    convert.DOCX,
+	},
+	{
+		Name:       "XLSX",
+		MIMETypes:  []string{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		Extensions: []string{".xlsx"},
+		Convert:    convert.XLSX,
+	},
+	{
+		Name: "Markdown/JSON/XML/YAML",
+		MIMETypes: []string{
+			"text/markdown", "text/x-markdown", "application/json", "text/json",
+			"application/xml", "text/xml", "application/yaml", "application/x-yaml", "text/yaml",
+			"text/html",
+		},
+		Extensions: []string{".md", ".markdown", ".json", ".xml", ".yaml", ".yml", ".html", ".htm"},
+		Convert:    convert.Text,
+	},
+	{
+		Name: "source code",
+		MIMETypes: []string{
+			"text/x-go", "text/x-python", "application/x-python", "text/x-java",
+			"text/x-c", "text/x-c++", "text/javascript", "application/javascript",
+			"application/x-javascript", "text/x-sh", "application/x-sh", "text/x-sql",
+			"application/sql", "text/css", "text/x-php", "application/x-php",
+		},
+		Extensions: []string{
+			".go", ".py", ".java", ".kt", ".c", ".h", ".cpp", ".hpp", ".cs", ".js",
+			".ts", ".tsx", ".jsx", ".rs", ".rb", ".php", ".swift", ".sh", ".sql",
+			".css", ".scss", ".dart", ".lua", ".toml", ".ini",
+		},
+		Convert: convert.Text,
+	},
+	{
+		Name:       "video",
+		MIMETypes:  []string{"video/mp4", "video/mpeg", "video/quicktime", "video/webm", "video/3gpp", "video/x-msvideo"},
+		Extensions: []string{".mp4", ".mpeg", ".mpg", ".mov", ".webm", ".3gp", ".avi"},
+	},
+	{
+		Name:       "image",
+		MIMETypes:  []string{"image/jpeg", "image/png", "image/webp", "image/heic", "image/heif"},
+		Extensions: []string{".jpg", ".jpeg", ".png", ".webp", ".heic", ".heif"},
+	},
+	{
+		Name:       "audio",
+		MIMETypes:  []string{"audio/ogg", "audio/mpeg", "audio/mp3", "audio/wav", "audio/aac", "audio/flac", "audio/mp4"},
+		Extensions: []string{".ogg", ".opus", ".mp3", ".wav", ".aac", ".flac", ".m4a"},
+	},
+}
+
+// lookupMediaType finds the entry for a file by its MIME type, falling back
+// to the file extension since phones often send source files and
+// spreadsheets as application/octet-stream. It also returns the MIME type
+// to send to Gemini.
+func lookupMediaType(mimeType, fileName string) (mediaType, string, bool) {
+	if base, _, err := mime.ParseMediaType(mimeType); err == nil {
+		mimeType = base
+	}
+	mimeType = strings.ToLower(mimeType)
+	for _, t := range mediaTypes {
+		for _, m := range t.MIMETypes {
+			if m == mimeType {
+				return t, mimeType, true
+			}
+		}
+	}
+
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if ext == "" {
+		return mediaType{}, "", false
+	}
+	for _, t := range mediaTypes {
+		for _, e := range t.Extensions {
+			if e == ext {
+				return t, t.MIMETypes[0], true
+			}
+		}
+	}
+	return mediaType{}, "", false
+}
+
+// supportedMediaNames lists the supported file types for rejection messages.
+func supportedMediaNames() string {
+	names := make([]string, len(mediaTypes))
+	for i, t := range mediaTypes {
+		names[i] = t.Name
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,66 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxOrderResponseSize caps the order status read from the shop.
+const maxOrderResponseSize = 64 << 10
+
+// orderLookupTimeout bounds how long a reply waits for the shop.
+var orderLookupTimeout = 10 * time.Second
+
+// errOrderNotFound is reported to the model when the shop does not know the
+// order, so it can ask the user to check the number.
+var errOrderNotFound = errors.New("order not found")
+
+// lookupOrder fetches the status of orderID from the shop endpoint
+// urlTemplate. {id} and {phone} in the template are replaced with the order
+// number and the phone number of the customer asking, so the shop can refuse
+// to reveal other customers' orders. The endpoint must answer with a JSON
+// object, which is passed to the model as is.
+func lookupOrder(ctx context.Context, urlTemplate, orderID, phone string) (map[string]any, error) {
+	orderID = strings.TrimSpace(orderID)
+	if orderID == "" {
+		return nil, errors.New("order number is missing")
+	}
+	orderURL := strings.NewReplacer(
+		"{id}", url.PathEscape(orderID),
+		"{phone}", url.QueryEscape(phone),
+	).Replace(urlTemplate)
+
+	ctx, cancel := context.WithTimeout(ctx, orderLookupTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, orderURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("order lookup failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errOrderNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("order lookup failed: %s", resp.Status)
+	}
+
+	var status map[string]any
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOrderResponseSize)).Decode(&status); err != nil {
+		return nil, fmt.Errorf("invalid order status: %w", err)
+	}
+	return status, nil
+}
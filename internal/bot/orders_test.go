@@ -0,0 +1,112 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLookupOrderSubstitutesIDAndPhone(t *testing.T) {
+	var gotPath, gotPhone string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotPhone = r.URL.EscapedPath(), r.URL.Query().Get("phone")
+		w.Write([]byte(`{"status": "shipped", "courier": "JNE"}`))
+	}))
+	defer srv.Close()
+
+	status, err := lookupOrder(context.Background(), srv.URL+"/orders/{id}?phone={phone}", " INV/42 ", "+62 811")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != "/orders/INV%2F42" {
+		t.Errorf("requested path %q, want the escaped order number", gotPath)
+	}
+	if gotPhone != "+62 811" {
+		t.Errorf("requested phone %q, want %q", gotPhone, "+62 811")
+	}
+	if status["status"] != "shipped" || status["courier"] != "JNE" {
+		t.Errorf("got status %v", status)
+	}
+}
+
+func TestLookupOrderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    string
+	}{
+		{
+			name:    "not found",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) },
+			want:    errOrderNotFound.Error(),
+		},
+		{
+			name: "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "database down", http.StatusInternalServerError)
+			},
+			want: "500 Internal Server Error",
+		},
+		{
+			name: "no content",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			},
+			want: "204 No Content",
+		},
+		{
+			name:    "not json",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("<html>")) },
+			want:    "invalid order status",
+		},
+		{
+			name: "too large",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"items": "` + strings.Repeat("x", maxOrderResponseSize) + `"}`))
+			},
+			want: "invalid order status",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+
+			_, err := lookupOrder(context.Background(), srv.URL+"/orders/{id}", "42", "62811")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupOrderRequiresOrderID(t *testing.T) {
+	if _, err := lookupOrder(context.Background(), "http://127.0.0.1:1/{id}", "  ", "62811"); err == nil {
+		t.Fatal("expected an error for a blank order number")
+	}
+}
+
+func TestLookupOrderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	defer func(timeout time.Duration) { orderLookupTimeout = timeout }(orderLookupTimeout)
+	orderLookupTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err := lookupOrder(context.Background(), srv.URL+"/orders/{id}", "42", "62811")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("lookup took %v, want it cut off by the timeout", elapsed)
+	}
+}
@@ -0,0 +1,221 @@
+package bot
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"gemini-whatsapp-bot/internal/db"
+
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+)
+
+// personaOptions maps the names accepted by /persona option to the columns
+// of the personas table.
+var personaOptions = map[string]string{
+	"model":       "model",
+	"temperature": "temperature",
+	"lang":        "language",
+}
+
+// persona returns the persona named name, or nil when name is empty or the
+// persona no longer exists.
+func (h *BotHandler) persona(name string) *db.Persona {
+	if name == "" {
+		return nil
+	}
+	p, err := h.DB.GetPersona(name)
+	if err != nil {
+		log.Printf("Failed to get persona %s: %v", name, err)
+		return nil
+	}
+	return p
+}
+
+// chatPersona returns the persona bound to the chat, if any.
+func (h *BotHandler) chatPersona(historyJID string) *db.Persona {
+	return h.persona(h.DB.GetChatSettings(historyJID).Persona)
+}
+
+// chatLanguage returns the language of the persona bound to the chat, or the
+// sender's own language when the persona does not set one.
+func (h *BotHandler) chatLanguage(senderJID, historyJID string) string {
+	if p := h.chatPersona(historyJID); p != nil && p.Language != "" {
+		return p.Language
+	}
+	return h.DB.GetUserLang(senderJID)
+}
+
+func (h *BotHandler) handlePersonaCommand(cmd *CommandContext) {
+	action := strings.ToLower(cmd.Arg(0))
+	rest := strings.TrimSpace(cmd.Arg(1))
+
+	// Personas are shared by every chat, so only owners may change them;
+	// admins may only pick one for their own chat.
+	switch action {
+	case "save", "option", "delete":
+		if !h.requireRole(cmd, RoleOwner) {
+			return
+		}
+	}
+
+	switch action {
+	case "", "list":
+		h.sendPersonaList(cmd)
+	case "set":
+		name := strings.ToLower(rest)
+		if name == "" || strings.ContainsAny(name, " \n") {
+			h.sendPersonaUsage(cmd)
+			return
+		}
+		if h.persona(name) == nil {
+			h.sendPersonaReply(cmd, "persona_not_found", name)
+			return
+		}
+		if err := h.DB.SetChatPersona(cmd.HistoryJID, name); err != nil {
+			h.sendPersonaReply(cmd, "settings_save_failed", name)
+			return
+		}
+		h.sendPersonaReply(cmd, "persona_set", name)
+		log.Printf("Persona for %s set to %s", cmd.HistoryJID, name)
+	case "clear":
+		if err := h.DB.SetChatPersona(cmd.HistoryJID, ""); err != nil {
+			h.sendPersonaReply(cmd, "settings_save_failed", "")
+			return
+		}
+		h.sendPersonaReply(cmd, "persona_cleared", "")
+		log.Printf("Persona for %s cleared", cmd.HistoryJID)
+	case "save":
+		name, prompt, _ := strings.Cut(rest, " ")
+		name = strings.ToLower(name)
+		prompt = strings.TrimSpace(prompt)
+		if name == "" || prompt == "" {
+			h.sendPersonaUsage(cmd)
+			return
+		}
+		if _, err := h.settings().Knowledge.WithPersona(prompt); err != nil {
+			log.Printf("Rejected prompt for persona %s: %v", name, err)
+			h.sendPersonaReply(cmd, "persona_invalid_prompt", name)
+			return
+		}
+		if err := h.DB.SavePersonaPrompt(name, prompt); err != nil {
+			h.sendPersonaReply(cmd, "settings_save_failed", name)
+			return
+		}
+		h.sendPersonaReply(cmd, "persona_saved", name)
+	case "option":
+		h.handlePersonaOption(cmd, strings.Fields(rest))
+	case "delete":
+		name := strings.ToLower(rest)
+		if h.persona(name) == nil {
+			h.sendPersonaReply(cmd, "persona_not_found", name)
+			return
+		}
+		if err := h.DB.DeletePersona(name); err != nil {
+			log.Printf("Failed to delete persona %s: %v", name, err)
+			h.sendPersonaReply(cmd, "settings_save_failed", name)
+			return
+		}
+		h.sendPersonaReply(cmd, "persona_deleted", name)
+	default:
+		h.sendPersonaUsage(cmd)
+	}
+}
+
+// handlePersonaOption handles "/persona option <name> <option> <value>".
+func (h *BotHandler) handlePersonaOption(cmd *CommandContext, fields []string) {
+	if len(fields) != 3 {
+		h.sendPersonaUsage(cmd)
+		return
+	}
+	name := strings.ToLower(fields[0])
+	column, ok := personaOptions[strings.ToLower(fields[1])]
+	if !ok {
+		h.sendPersonaUsage(cmd)
+		return
+	}
+	if h.persona(name) == nil {
+		h.sendPersonaReply(cmd, "persona_not_found", name)
+		return
+	}
+
+	var value any
+	raw := strings.ToLower(fields[2])
+	switch {
+	case raw == "default":
+		value = nil
+	case column == "model":
+		if !h.isAvailableModel(raw) {
+			msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+				MessageID: "model_not_available",
+				TemplateData: map[string]string{
+					"Model":  raw,
+					"Models": strings.Join(h.settings().AvailableModels, ", "),
+				},
+			})
+			h.sendMessage(cmd.ChatJID, msg)
+			return
+		}
+		value = raw
+	case column == "temperature":
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil || f < 0 || f > 2 {
+			h.sendPersonaUsage(cmd)
+			return
+		}
+		value = f
+	case column == "language":
+		if !isSupportedLanguage(raw) {
+			msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+				MessageID:    "lang_not_found",
+				TemplateData: map[string]string{"Lang": raw},
+			})
+			h.sendMessage(cmd.ChatJID, msg)
+			return
+		}
+		value = raw
+	default:
+		value = raw
+	}
+
+	if err := h.DB.SetPersonaOption(name, column, value); err != nil {
+		h.sendPersonaReply(cmd, "settings_save_failed", name)
+		return
+	}
+	h.sendPersonaReply(cmd, "persona_saved", name)
+}
+
+func (h *BotHandler) sendPersonaList(cmd *CommandContext) {
+	names, err := h.DB.ListPersonas()
+	if err != nil {
+		log.Printf("Failed to list personas: %v", err)
+	}
+	available := strings.Join(names, ", ")
+	if available == "" {
+		available = "-"
+	}
+
+	messageID := "persona_current"
+	current := h.DB.GetChatSettings(cmd.HistoryJID).Persona
+	if current == "" {
+		messageID = "persona_default"
+	}
+	msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+		MessageID:    messageID,
+		TemplateData: map[string]string{"Name": current, "Personas": available},
+	})
+	h.sendMessage(cmd.ChatJID, msg)
+}
+
+func (h *BotHandler) sendPersonaReply(cmd *CommandContext, messageID, name string) {
+	msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+		MessageID:    messageID,
+		TemplateData: map[string]string{"Name": name},
+	})
+	h.sendMessage(cmd.ChatJID, msg)
+}
+
+func (h *BotHandler) sendPersonaUsage(cmd *CommandContext) {
+	msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "persona_usage"})
+	h.sendMessage(cmd.ChatJID, msg)
+}
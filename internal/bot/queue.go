@@ -0,0 +1,102 @@
+package bot
+
+import (
+	"log"
+	"sync"
+
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// ChatQueue runs jobs with bounded concurrency while keeping the jobs of a
+// single chat in order. Different chats are processed in parallel.
+type ChatQueue struct {
+	mu       sync.Mutex
+	chats    map[string]*chatJobs
+	slots    chan struct{}
+	maxDepth int
+}
+
+type chatJobs struct {
+	pending []func()
+}
+
+// NewChatQueue creates a queue that runs at most concurrency jobs at once and
+// holds at most maxDepth waiting jobs per chat.
+func NewChatQueue(concurrency, maxDepth int) *ChatQueue {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if maxDepth < 1 {
+		maxDepth = 1
+	}
+	return &ChatQueue{
+		chats:    make(map[string]*chatJobs),
+		slots:    make(chan struct{}, concurrency),
+		maxDepth: maxDepth,
+	}
+}
+
+// Submit queues job behind any earlier jobs for chat. It reports false
+// without queueing when the chat already has maxDepth jobs waiting.
+func (q *ChatQueue) Submit(chat string, job func()) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs, running := q.chats[chat]
+	if !running {
+		jobs = &chatJobs{}
+		q.chats[chat] = jobs
+	}
+	if len(jobs.pending) >= q.maxDepth {
+		return false
+	}
+	jobs.pending = append(jobs.pending, job)
+	if !running {
+		go q.drain(chat, jobs)
+	}
+	return true
+}
+
+// drain runs the jobs of one chat until none are left.
+func (q *ChatQueue) drain(chat string, jobs *chatJobs) {
+	for {
+		q.mu.Lock()
+		if len(jobs.pending) == 0 {
+			delete(q.chats, chat)
+			q.mu.Unlock()
+			return
+		}
+		job := jobs.pending[0]
+		jobs.pending = jobs.pending[1:]
+		q.mu.Unlock()
+
+		q.slots <- struct{}{}
+		q.run(chat, job)
+		<-q.slots
+	}
+}
+
+func (q *ChatQueue) run(chat string, job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered from panic while processing job for %s: %v", chat, r)
+		}
+	}()
+	job()
+}
+
+// runQueued hands job to the chat queue, replying with a localized busy
+// message when the chat has too many requests waiting. Without a queue the
+// job runs immediately.
+func (h *BotHandler) runQueued(chatJID types.JID, localizer *goi18n.Localizer, job func()) {
+	if h.Queue == nil {
+		job()
+		return
+	}
+	if !h.Queue.Submit(chatJID.String(), job) {
+		log.Printf("Queue for %s is full, rejecting request", chatJID)
+		msg, _ := localizer.Localize(&goi18n.LocalizeConfig{MessageID: "queue_full"})
+		h.sendMessage(chatJID, msg)
+	}
+}
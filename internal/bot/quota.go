@@ -0,0 +1,134 @@
+package bot
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	geminiClient "gemini-whatsapp-bot/pkg/gemini"
+
+	"github.com/google/generative-ai-go/genai"
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// quotaDay returns the day usage is counted on at now, and when that day
+// ends and the quotas reset.
+func quotaDay(now time.Time) (string, time.Time) {
+	y, m, d := now.Date()
+	return now.Format("2006-01-02"), time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+}
+
+// quotaKey returns the key the usage of senderJID is counted under, so that
+// the devices of one account share a quota.
+func quotaKey(senderJID string) string {
+	if user := normalizeUser(senderJID); user != "" {
+		return user
+	}
+	return senderJID
+}
+
+// admitRequest applies the rate limits and daily quotas to a message that is
+// about to be sent to Gemini. It counts the message and reports true if the
+// sender is within every limit; otherwise it tells the sender when to try
+// again and reports false.
+func (h *BotHandler) admitRequest(senderJID string, chatJID types.JID, localizer *goi18n.Localizer) bool {
+	user := quotaKey(senderJID)
+	settings := h.settings()
+	day, reset := quotaDay(time.Now())
+
+	messages, tokens := h.DB.GetDailyUsage(user, day)
+	if (settings.DailyMessageQuota > 0 && messages >= int64(settings.DailyMessageQuota)) ||
+		(settings.DailyTokenQuota > 0 && tokens >= int64(settings.DailyTokenQuota)) {
+		log.Printf("Sender %s is over the daily quota, ignoring", senderJID)
+		if h.notices.due("quota:"+user, time.Until(reset)) {
+			msg, _ := localizer.Localize(&goi18n.LocalizeConfig{
+				MessageID:    "quota_exceeded",
+				TemplateData: map[string]string{"Time": reset.Format("2006-01-02 15:04")},
+			})
+			h.sendMessage(chatJID, msg)
+		}
+		return false
+	}
+
+	ok, wait := h.SenderLimiter.Allow(user)
+	if ok {
+		if ok, wait = h.ChatLimiter.Allow(chatJID.String()); !ok {
+			h.SenderLimiter.Refund(user)
+		}
+	}
+	if !ok {
+		log.Printf("Sender %s in %s is rate limited for %s, ignoring", senderJID, chatJID, wait)
+		if h.notices.due("rate:"+user, wait) {
+			msg, _ := localizer.Localize(&goi18n.LocalizeConfig{
+				MessageID:    "rate_limited",
+				TemplateData: map[string]int{"Seconds": int(math.Ceil(wait.Seconds()))},
+			})
+			h.sendMessage(chatJID, msg)
+		}
+		return false
+	}
+
+	h.DB.AddDailyUsage(user, day, 1, 0)
+	return true
+}
+
+// recordTokens adds tokens to the daily usage of senderJID.
+func (h *BotHandler) recordTokens(senderJID string, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	day, _ := quotaDay(time.Now())
+	h.DB.AddDailyUsage(quotaKey(senderJID), day, 0, int64(tokens))
+}
+
+// contentTokens estimates the tokens of a request's contents.
+func contentTokens(contents []*genai.Content) int {
+	tokens := 0
+	for _, content := range contents {
+		for _, part := range content.Parts {
+			switch p := part.(type) {
+			case genai.Text:
+				tokens += geminiClient.EstimateTokens(string(p))
+			case genai.Blob:
+				tokens += mediaSizeTokens(int64(len(p.Data)), p.MIMEType)
+			}
+		}
+	}
+	return tokens
+}
+
+func (h *BotHandler) handleQuotaCommand(cmd *CommandContext) {
+	settings := h.settings()
+	day, reset := quotaDay(time.Now())
+	messages, tokens := h.DB.GetDailyUsage(quotaKey(cmd.SenderJID), day)
+
+	unlimited, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "quota_unlimited"})
+	remaining := func(used int64, quota int) string {
+		if quota <= 0 {
+			return unlimited
+		}
+		return strconv.FormatInt(max(int64(quota)-used, 0), 10)
+	}
+	rate := func(l *RateLimiter) string {
+		if l == nil {
+			return unlimited
+		}
+		return strconv.Itoa(l.PerMinute())
+	}
+
+	msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+		MessageID: "quota_status",
+		TemplateData: map[string]string{
+			"Messages":          strconv.FormatInt(messages, 10),
+			"Tokens":            strconv.FormatInt(tokens, 10),
+			"MessagesRemaining": remaining(messages, settings.DailyMessageQuota),
+			"TokensRemaining":   remaining(tokens, settings.DailyTokenQuota),
+			"SenderRate":        rate(h.SenderLimiter),
+			"ChatRate":          rate(h.ChatLimiter),
+			"Reset":             reset.Format("2006-01-02 15:04"),
+		},
+	})
+	h.sendMessage(cmd.ChatJID, msg)
+}
@@ -0,0 +1,164 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// maxQuoteRunes caps how much of a quoted message is added to the prompt.
+const maxQuoteRunes = 1000
+
+// quotedMessage is the message a user replied to.
+type quotedMessage struct {
+	// Sender is the phone number or LID of the quoted message's author.
+	Sender   string
+	FromBot  bool
+	Text     string
+	Media    whatsmeow.DownloadableMessage
+	MIMEType string
+}
+
+// repliesToBot reports whether the user replied to one of the bot's own
+// messages.
+func (q *quotedMessage) repliesToBot() bool {
+	return q != nil && q.FromBot
+}
+
+// messageContextInfo returns the ContextInfo of whichever kind of message
+// msg carries.
+func messageContextInfo(msg *proto.Message) *proto.ContextInfo {
+	switch {
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetContextInfo()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetContextInfo()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetContextInfo()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetContextInfo()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage().GetContextInfo()
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage().GetContextInfo()
+	}
+	return nil
+}
+
+// isOwnJID reports whether jid, in phone number or LID form, is the bot's
+// own account.
+func (h *BotHandler) isOwnJID(jid string) bool {
+	parsed, err := types.ParseJID(jid)
+	if err != nil || parsed.User == "" {
+		return false
+	}
+	if id := h.Client.Store.ID; id != nil && parsed.User == id.User {
+		return true
+	}
+	lid := h.Client.Store.GetLID()
+	return !lid.IsEmpty() && parsed.User == lid.User
+}
+
+// quotedMessage extracts the message quoted by a reply, or nil if the
+// message is not a reply.
+func (h *BotHandler) quotedMessage(ci *proto.ContextInfo) *quotedMessage {
+	quoted := ci.GetQuotedMessage()
+	if quoted == nil {
+		return nil
+	}
+
+	q := &quotedMessage{FromBot: h.isOwnJID(ci.GetParticipant())}
+	if jid, err := types.ParseJID(ci.GetParticipant()); err == nil {
+		q.Sender = jid.User
+	}
+
+	switch {
+	case quoted.GetConversation() != "":
+		q.Text = quoted.GetConversation()
+	case quoted.GetExtendedTextMessage() != nil:
+		q.Text = quoted.GetExtendedTextMessage().GetText()
+	case quoted.GetImageMessage() != nil:
+		img := quoted.GetImageMessage()
+		q.Text, q.Media, q.MIMEType = img.GetCaption(), img, img.GetMimetype()
+	case quoted.GetVideoMessage() != nil:
+		video := quoted.GetVideoMessage()
+		q.Text, q.Media, q.MIMEType = video.GetCaption(), video, video.GetMimetype()
+	case quoted.GetDocumentMessage() != nil:
+		doc := quoted.GetDocumentMessage()
+		q.Text = strings.TrimSpace(doc.GetFileName() + " " + doc.GetCaption())
+		q.Media, q.MIMEType = doc, doc.GetMimetype()
+	case quoted.GetAudioMessage() != nil:
+		audio := quoted.GetAudioMessage()
+		q.Media, q.MIMEType = audio, audio.GetMimetype()
+	case quoted.GetStickerMessage() != nil:
+		sticker := quoted.GetStickerMessage()
+		q.Media, q.MIMEType = sticker, sticker.GetMimetype()
+	}
+	return q
+}
+
+// context describes the quoted message for the prompt.
+func (q *quotedMessage) context() string {
+	author := "another user"
+	switch {
+	case q.FromBot:
+		author = "your earlier message"
+	case q.Sender != "":
+		author = "a message from " + q.Sender
+	}
+
+	text := q.Text
+	if utf8.RuneCountInString(text) > maxQuoteRunes {
+		text = string([]rune(text)[:maxQuoteRunes]) + "…"
+	}
+	switch {
+	case text != "":
+		return fmt.Sprintf("[Replying to %s: %q]", author, text)
+	case q.Media != nil:
+		return fmt.Sprintf("[Replying to %s with an attached file]", author)
+	}
+	return fmt.Sprintf("[Replying to %s]", author)
+}
+
+// applyQuote adds the quoted message to turn. Media from the quoted message
+// is attached when the turn has none of its own, so "what is in this
+// picture?" works as a reply to an image.
+func (h *BotHandler) applyQuote(turn *userTurn) {
+	q := turn.Quote
+	quoteContext := q.context()
+	turn.Prompt = quoteContext + "\n" + turn.Prompt
+	turn.HistoryText = quoteContext + "\n" + turn.HistoryText
+
+	if turn.Media != nil || q.Media == nil {
+		return
+	}
+	mt, mimeType, ok := lookupMediaType(q.MIMEType, "")
+	if !ok {
+		return
+	}
+	data, err := h.whatsApp().Download(context.Background(), q.Media)
+	if err != nil {
+		log.Printf("Failed to download quoted media: %v", err)
+		return
+	}
+	if mt.Convert != nil {
+		text, err := mt.Convert(data)
+		if err != nil {
+			log.Printf("Failed to convert quoted %s: %v", mt.Name, err)
+			return
+		}
+		data, mimeType = []byte(text), "text/plain"
+	}
+	media, err := h.saveMedia(data, mimeType)
+	if err != nil {
+		log.Printf("Failed to store quoted media: %v", err)
+		media = &storedMedia{MIMEType: mimeType, Data: data}
+	}
+	turn.Media = media
+}
@@ -0,0 +1,108 @@
+package bot
+
+import (
+	"sync"
+	"time"
+)
+
+// maxIdleBuckets is how many buckets a RateLimiter keeps before it forgets
+// the ones that have refilled completely.
+const maxIdleBuckets = 10000
+
+// RateLimiter is a set of token buckets, one per key. Each bucket holds at
+// most burst tokens and refills at the configured rate; every request takes
+// one token.
+type RateLimiter struct {
+	mu      sync.Mutex
+	perSec  float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter allows perMinute requests per key per minute, with bursts
+// of up to burst requests. It returns nil, which allows everything, when
+// perMinute is not positive.
+func NewRateLimiter(perMinute, burst int) *RateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		perSec:  float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket of key. When the bucket is empty it
+// reports false and how long until the next token is available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b := l.refill(key, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.perSec * float64(time.Second))
+	return false, wait
+}
+
+// Refund returns a token taken by Allow, for a request that was turned
+// down by a later check.
+func (l *RateLimiter) Refund(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.refill(key, time.Now())
+	b.tokens = min(b.tokens+1, l.burst)
+}
+
+// PerMinute returns the sustained rate of the limiter, or 0 if it is nil.
+func (l *RateLimiter) PerMinute() int {
+	if l == nil {
+		return 0
+	}
+	return int(l.perSec*60 + 0.5)
+}
+
+// refill returns the bucket of key with the tokens earned since it was last
+// used. l.mu must be held.
+func (l *RateLimiter) refill(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.forgetFull(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+		return b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*l.perSec, l.burst)
+	b.last = now
+	return b
+}
+
+// forgetFull drops buckets that would be full by now, since a new bucket
+// behaves the same. l.mu must be held.
+func (l *RateLimiter) forgetFull(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.perSec >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package bot
+
+import (
+	"time"
+
+	"gemini-whatsapp-bot/internal/knowledge"
+	"gemini-whatsapp-bot/internal/tts"
+	geminiClient "gemini-whatsapp-bot/pkg/gemini"
+
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+)
+
+// Settings is the part of the bot configuration that can be replaced while
+// the bot runs. It is swapped as a whole, so a message is always handled with
+// one consistent version.
+type Settings struct {
+	Bundle           *goi18n.Bundle
+	Knowledge        *knowledge.Knowledge
+	KnowledgeEnabled bool
+	RetrievalTopK    int
+	// HistoryTokenBudget caps the estimated tokens of history sent with a
+	// request. Older messages are summarized.
+	HistoryTokenBudget int
+	StoreLatitude      float64
+	StoreLongitude     float64
+	StoreName          string
+	StoreAddress       string
+	MenuImagePaths     []string
+	MenuPDFPath        string
+	// OrderStatusURL is the shop endpoint Gemini looks orders up at, with
+	// {id} and {phone} standing for the order number and the customer.
+	OrderStatusURL  string
+	StreamReplies   bool
+	TriggerKeywords []string
+	// OwnerJIDs are the accounts allowed to run every command, given as
+	// phone numbers or JIDs.
+	OwnerJIDs []string
+	// AccessMode is used by chats without their own access mode.
+	AccessMode string
+	// AccessDeniedNotice tells users in private chats that they may not use
+	// the bot instead of ignoring them silently.
+	AccessDeniedNotice bool
+	// DailyMessageQuota and DailyTokenQuota cap what one user may send to
+	// Gemini per day. Zero means no limit.
+	DailyMessageQuota int
+	DailyTokenQuota   int
+	// ModelPrices estimate the cost of the recorded token usage.
+	ModelPrices map[string]geminiClient.Price
+	// TTS speaks replies in chats whose voice mode is voice. Nil disables
+	// spoken replies.
+	TTS tts.Synthesizer
+	// ResponseCacheTTL is how long replies to standalone questions are
+	// reused. Zero disables the response cache.
+	ResponseCacheTTL time.Duration
+	AvailableModels  []string
+}
+
+// SetSettings replaces the bot settings. Messages already being handled
+// finish with the settings they started with.
+func (h *BotHandler) SetSettings(s *Settings) {
+	h.current.Store(s)
+}
+
+// settings returns the current settings. Callers should read it once per
+// message and keep the result.
+func (h *BotHandler) settings() *Settings {
+	if s := h.current.Load(); s != nil {
+		return s
+	}
+	return &Settings{}
+}
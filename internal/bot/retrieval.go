@@ -0,0 +1,32 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// relevantPassages returns the indexed passages most related to prompt,
+// formatted for the system instruction. It is empty when no index is
+// configured or nothing matches.
+func (h *BotHandler) relevantPassages(prompt string) string {
+	if h.Retriever == nil {
+		return ""
+	}
+	matches, err := h.Retriever.Search(prompt, h.settings().RetrievalTopK)
+	if err != nil {
+		log.Printf("Knowledge search failed: %v", err)
+		return ""
+	}
+	if len(matches) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("RELEVANT DOCUMENTS (use them to answer if they help):")
+	for _, m := range matches {
+		fmt.Fprintf(&sb, "\n\n[%s]\n%s", filepath.Base(m.Source), m.Content)
+	}
+	return sb.String()
+}
@@ -0,0 +1,240 @@
+package bot
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Role is what a sender is allowed to do. Roles are ordered, so a higher
+// role may run every command a lower one can.
+type Role int
+
+const (
+	RoleUser Role = iota
+	// RoleAdmin is held by group admins within their group and by users an
+	// owner granted it to everywhere.
+	RoleAdmin
+	// RoleOwner is held by the accounts in OWNER_JIDS and by users an owner
+	// granted it to.
+	RoleOwner
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleAdmin:
+		return "admin"
+	case RoleOwner:
+		return "owner"
+	}
+	return "user"
+}
+
+// parseRole maps a role name to a Role. Only roles that can be granted are
+// accepted.
+func parseRole(name string) (Role, bool) {
+	switch strings.ToLower(name) {
+	case "admin":
+		return RoleAdmin, true
+	case "owner":
+		return RoleOwner, true
+	}
+	return RoleUser, false
+}
+
+// normalizeUser reduces a JID, phone number or @mention to the user part of
+// the account, e.g. "+62 812-3456" and "628123456@s.whatsapp.net" both
+// become "628123456". It returns an empty string if nothing is left.
+func normalizeUser(value string) string {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "@")
+	if strings.Contains(value, "@") {
+		jid, err := types.ParseJID(value)
+		if err != nil {
+			return ""
+		}
+		return jid.User
+	}
+	var sb strings.Builder
+	for _, r := range value {
+		if r >= '0' && r <= '9' {
+			sb.WriteRune(r)
+		} else if !strings.ContainsRune("+-() ", r) {
+			return ""
+		}
+	}
+	return sb.String()
+}
+
+// senderIDs returns the user parts the sender of msg is known by. A message
+// in a group may be addressed by LID, in which case the phone number is the
+// alternative address.
+func senderIDs(msg *events.Message) []string {
+	var ids []string
+	for _, jid := range []types.JID{msg.Info.Sender, msg.Info.SenderAlt} {
+		if jid.User != "" {
+			ids = append(ids, jid.User)
+		}
+	}
+	return ids
+}
+
+// commandSenderIDs is senderIDs for the message that invoked cmd.
+func commandSenderIDs(cmd *CommandContext) []string {
+	if cmd.Msg != nil {
+		return senderIDs(cmd.Msg)
+	}
+	if id := normalizeUser(cmd.SenderJID); id != "" {
+		return []string{id}
+	}
+	return nil
+}
+
+// senderRole returns the highest role the sender of cmd holds in the chat it
+// was sent in.
+func (h *BotHandler) senderRole(cmd *CommandContext) Role {
+	return h.roleOf(commandSenderIDs(cmd), cmd.ChatJID, cmd.IsGroup)
+}
+
+// roleOf returns the highest role of the user known by ids in chatJID.
+func (h *BotHandler) roleOf(ids []string, chatJID types.JID, isGroup bool) Role {
+	role := RoleUser
+
+	for _, owner := range h.settings().OwnerJIDs {
+		owner = normalizeUser(owner)
+		for _, id := range ids {
+			if id == owner {
+				return RoleOwner
+			}
+		}
+	}
+
+	for _, id := range ids {
+		if granted, ok := parseRole(h.DB.GetRole(id)); ok && granted > role {
+			role = granted
+		}
+	}
+	if role >= RoleAdmin || !isGroup {
+		return role
+	}
+
+	info, err := h.groupInfo(chatJID)
+	if err != nil {
+		log.Printf("Failed to get group info for %s: %v", chatJID, err)
+		return role
+	}
+	for _, p := range info.Participants {
+		if !p.IsAdmin && !p.IsSuperAdmin {
+			continue
+		}
+		for _, id := range ids {
+			if id == p.JID.User || id == p.PhoneNumber.User || id == p.LID.User {
+				return RoleAdmin
+			}
+		}
+	}
+	return role
+}
+
+func (h *BotHandler) handleGrantCommand(cmd *CommandContext) {
+	user := normalizeUser(cmd.Arg(0))
+	if user == "" {
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID:    "role_invalid_user",
+			TemplateData: map[string]string{"User": cmd.Arg(0)},
+		})
+		h.sendMessage(cmd.ChatJID, msg)
+		return
+	}
+
+	role := RoleAdmin
+	if name := cmd.Arg(1); name != "" {
+		var ok bool
+		if role, ok = parseRole(name); !ok {
+			msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+				MessageID:    "role_invalid",
+				TemplateData: map[string]string{"Role": name},
+			})
+			h.sendMessage(cmd.ChatJID, msg)
+			return
+		}
+	}
+
+	grantedBy := ""
+	if ids := commandSenderIDs(cmd); len(ids) > 0 {
+		grantedBy = ids[0]
+	}
+	if err := h.DB.SetRole(user, role.String(), grantedBy); err != nil {
+		errorMsg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "settings_save_failed"})
+		h.sendMessage(cmd.ChatJID, errorMsg)
+		return
+	}
+
+	msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+		MessageID:    "role_granted",
+		TemplateData: map[string]string{"User": user, "Role": role.String()},
+	})
+	h.sendMessage(cmd.ChatJID, msg)
+	log.Printf("%s granted role %s to %s", cmd.SenderJID, role, user)
+}
+
+func (h *BotHandler) handleRevokeCommand(cmd *CommandContext) {
+	user := normalizeUser(cmd.Arg(0))
+	if user == "" {
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID:    "role_invalid_user",
+			TemplateData: map[string]string{"User": cmd.Arg(0)},
+		})
+		h.sendMessage(cmd.ChatJID, msg)
+		return
+	}
+
+	err := h.DB.DeleteRole(user)
+	if err == sql.ErrNoRows {
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID:    "role_not_found",
+			TemplateData: map[string]string{"User": user},
+		})
+		h.sendMessage(cmd.ChatJID, msg)
+		return
+	}
+	if err != nil {
+		errorMsg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "settings_save_failed"})
+		h.sendMessage(cmd.ChatJID, errorMsg)
+		return
+	}
+
+	msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+		MessageID:    "role_revoked",
+		TemplateData: map[string]string{"User": user},
+	})
+	h.sendMessage(cmd.ChatJID, msg)
+	log.Printf("%s revoked the role of %s", cmd.SenderJID, user)
+}
+
+func (h *BotHandler) handleRolesCommand(cmd *CommandContext) {
+	grants, err := h.DB.ListRoles()
+	if err != nil {
+		log.Printf("Failed to list roles: %v", err)
+	}
+
+	header, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "roles_header"})
+	var sb strings.Builder
+	sb.WriteString(header)
+	for _, owner := range h.settings().OwnerJIDs {
+		if user := normalizeUser(owner); user != "" {
+			sb.WriteString("\n- " + user + ": " + RoleOwner.String())
+		}
+	}
+	for _, g := range grants {
+		sb.WriteString("\n- " + g.JID + ": " + g.Role)
+	}
+	if len(grants) == 0 && len(h.settings().OwnerJIDs) == 0 {
+		empty, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "roles_empty"})
+		sb.WriteString("\n" + empty)
+	}
+	h.sendMessage(cmd.ChatJID, sb.String())
+}
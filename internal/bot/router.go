@@ -0,0 +1,260 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// CommandScope restricts where a command may be used.
+type CommandScope int
+
+const (
+	ScopeAll CommandScope = iota
+	ScopeGroup
+	ScopeDM
+)
+
+// CommandArg describes a single positional argument of a command.
+// A Rest argument swallows the remainder of the message, spaces included.
+type CommandArg struct {
+	Name     string
+	Required bool
+	Rest     bool
+}
+
+// CommandContext carries everything a command handler needs about the
+// message that invoked it.
+type CommandContext struct {
+	Msg        *events.Message
+	ChatJID    types.JID
+	SenderJID  string
+	HistoryJID string
+	IsGroup    bool
+	UserName   string
+	Quote      *quotedMessage
+	Name       string
+	Args       []string
+	RawArgs    string
+	Localizer  *goi18n.Localizer
+}
+
+// Arg returns the i-th argument or an empty string if it was not given.
+func (c *CommandContext) Arg(i int) string {
+	if i < len(c.Args) {
+		return c.Args[i]
+	}
+	return ""
+}
+
+type Command struct {
+	Name    string
+	Aliases []string
+	Args    []CommandArg
+	Scope   CommandScope
+	// Trigger marks commands whose argument is a prompt for Gemini, so that
+	// media captions and group messages can be recognised with the same rules.
+	Trigger bool
+	// Role is the role required to run the command. GroupRole, when set,
+	// is required instead in groups, for commands that affect everyone there.
+	Role      Role
+	GroupRole Role
+	// DescriptionID is the i18n message ID shown in the /help listing.
+	DescriptionID string
+	Handler       func(h *BotHandler, cmd *CommandContext)
+}
+
+// Usage renders the command signature, e.g. "/lang <code>".
+func (c *Command) Usage() string {
+	var sb strings.Builder
+	sb.WriteString("/" + c.Name)
+	for _, arg := range c.Args {
+		if arg.Required {
+			fmt.Fprintf(&sb, " <%s>", arg.Name)
+		} else {
+			fmt.Fprintf(&sb, " [%s]", arg.Name)
+		}
+	}
+	return sb.String()
+}
+
+func (c *Command) allowedIn(isGroup bool) bool {
+	switch c.Scope {
+	case ScopeGroup:
+		return isGroup
+	case ScopeDM:
+		return !isGroup
+	}
+	return true
+}
+
+// requiredRole returns the role needed to run the command in a group or a
+// private chat.
+func (c *Command) requiredRole(isGroup bool) Role {
+	if isGroup && c.GroupRole != RoleUser {
+		return c.GroupRole
+	}
+	return c.Role
+}
+
+// parseArgs splits the raw argument string according to the command's schema.
+// It reports false when a required argument is missing.
+func (c *Command) parseArgs(raw string) ([]string, bool) {
+	fields := strings.Fields(raw)
+	var args []string
+	for i, spec := range c.Args {
+		if spec.Rest {
+			rest := raw
+			for j := 0; j < i; j++ {
+				_, rest, _ = strings.Cut(strings.TrimSpace(rest), " ")
+			}
+			rest = strings.TrimSpace(rest)
+			if rest == "" {
+				return args, !spec.Required
+			}
+			return append(args, rest), true
+		}
+		if i >= len(fields) {
+			if spec.Required {
+				return nil, false
+			}
+			continue
+		}
+		args = append(args, fields[i])
+	}
+	return args, true
+}
+
+type CommandRegistry struct {
+	commands []*Command
+	byName   map[string]*Command
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{byName: make(map[string]*Command)}
+}
+
+// Register adds a command under its name and all of its aliases.
+// Registering a name twice replaces the previous binding.
+func (r *CommandRegistry) Register(cmd *Command) {
+	r.commands = append(r.commands, cmd)
+	r.byName[strings.ToLower(cmd.Name)] = cmd
+	for _, alias := range cmd.Aliases {
+		r.byName[strings.ToLower(alias)] = cmd
+	}
+}
+
+func (r *CommandRegistry) Lookup(name string) (*Command, bool) {
+	cmd, ok := r.byName[strings.ToLower(name)]
+	return cmd, ok
+}
+
+// Commands returns the registered commands sorted by name.
+func (r *CommandRegistry) Commands() []*Command {
+	cmds := make([]*Command, len(r.commands))
+	copy(cmds, r.commands)
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// splitCommand breaks "/name rest of text" into its name and raw arguments.
+func splitCommand(text string) (name, rawArgs string, ok bool) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "/") || len(text) < 2 {
+		return "", "", false
+	}
+	body := text[1:]
+	if idx := strings.IndexAny(body, " \t\n"); idx >= 0 {
+		return strings.ToLower(body[:idx]), strings.TrimSpace(body[idx+1:]), true
+	}
+	return strings.ToLower(body), "", true
+}
+
+// Match resolves text to a registered command.
+func (r *CommandRegistry) Match(text string) (*Command, string, bool) {
+	name, rawArgs, ok := splitCommand(text)
+	if !ok {
+		return nil, "", false
+	}
+	cmd, found := r.Lookup(name)
+	if !found {
+		return nil, "", false
+	}
+	return cmd, rawArgs, true
+}
+
+// TriggerPrompt strips a trigger command such as "/ask" from text and
+// returns the remaining prompt. It reports false when text does not start
+// with a trigger command.
+func (r *CommandRegistry) TriggerPrompt(text string) (string, bool) {
+	cmd, rawArgs, ok := r.Match(text)
+	if !ok || !cmd.Trigger {
+		return "", false
+	}
+	return rawArgs, true
+}
+
+// dispatchCommand runs the registered command that text starts with. It
+// reports false when text is not a known command so the caller can treat it
+// as a normal message.
+func (h *BotHandler) dispatchCommand(text string, cmd *CommandContext) bool {
+	command, rawArgs, ok := h.Commands.Match(text)
+	if !ok {
+		return false
+	}
+
+	if !command.allowedIn(cmd.IsGroup) {
+		messageID := "command_group_only"
+		if command.Scope == ScopeDM {
+			messageID = "command_dm_only"
+		}
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID:    messageID,
+			TemplateData: map[string]string{"Command": "/" + command.Name},
+		})
+		h.sendMessage(cmd.ChatJID, msg)
+		return true
+	}
+
+	cmd.Name = command.Name
+	if !h.requireRole(cmd, command.requiredRole(cmd.IsGroup)) {
+		return true
+	}
+
+	args, valid := command.parseArgs(rawArgs)
+	if !valid {
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID:    "command_usage",
+			TemplateData: map[string]string{"Usage": command.Usage()},
+		})
+		h.sendMessage(cmd.ChatJID, msg)
+		return true
+	}
+
+	cmd.Args = args
+	cmd.RawArgs = rawArgs
+	command.Handler(h, cmd)
+	return true
+}
+
+// requireRole reports whether the sender of cmd holds at least role, and
+// tells them the command is forbidden when they do not. dispatchCommand
+// checks the Role of every command with it; handlers only call it for
+// subcommands that need more than that.
+func (h *BotHandler) requireRole(cmd *CommandContext, role Role) bool {
+	if h.senderRole(cmd) >= role {
+		return true
+	}
+	log.Printf("Denied /%s to %s in %s", cmd.Name, cmd.SenderJID, cmd.ChatJID)
+	msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+		MessageID:    "command_forbidden",
+		TemplateData: map[string]string{"Command": "/" + cmd.Name},
+	})
+	h.sendMessage(cmd.ChatJID, msg)
+	return false
+}
@@ -0,0 +1,156 @@
+package bot
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	geminiClient "gemini-whatsapp-bot/pkg/gemini"
+
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+)
+
+// chatParams maps the names accepted by /params to chat_settings columns.
+var chatParams = map[string]string{
+	"temperature": "temperature",
+	"top_p":       "top_p",
+	"max_tokens":  "max_output_tokens",
+}
+
+// geminiOptions returns the model and generation overrides stored for the
+// chat. Overrides set with /model and /params win over those of the chat's
+// persona, and unset fields fall back to the defaults of the Gemini client.
+func (h *BotHandler) geminiOptions(historyJID string) geminiClient.Options {
+	settings := h.DB.GetChatSettings(historyJID)
+	var opts geminiClient.Options
+	if persona := h.persona(settings.Persona); persona != nil {
+		opts.Model = persona.Model
+		if persona.Temperature != nil {
+			t := float32(*persona.Temperature)
+			opts.Temperature = &t
+		}
+	}
+	if settings.Model != "" {
+		opts.Model = settings.Model
+	}
+	if settings.Temperature != nil {
+		t := float32(*settings.Temperature)
+		opts.Temperature = &t
+	}
+	if settings.TopP != nil {
+		p := float32(*settings.TopP)
+		opts.TopP = &p
+	}
+	if settings.MaxOutputTokens != nil {
+		n := int32(*settings.MaxOutputTokens)
+		opts.MaxOutputTokens = &n
+	}
+	return opts
+}
+
+func (h *BotHandler) isAvailableModel(model string) bool {
+	for _, available := range h.settings().AvailableModels {
+		if model == available {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *BotHandler) handleModelCommand(cmd *CommandContext) {
+	model := strings.ToLower(cmd.Arg(0))
+
+	if model == "" {
+		current := h.DB.GetChatSettings(cmd.HistoryJID).Model
+		if current == "" {
+			current = h.Gemini.DefaultModel()
+		}
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID: "model_current",
+			TemplateData: map[string]string{
+				"Model":  current,
+				"Models": strings.Join(h.settings().AvailableModels, ", "),
+			},
+		})
+		h.sendMessage(cmd.ChatJID, msg)
+		return
+	}
+
+	if model == "default" {
+		model = ""
+	} else if !h.isAvailableModel(model) {
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID: "model_not_available",
+			TemplateData: map[string]string{
+				"Model":  model,
+				"Models": strings.Join(h.settings().AvailableModels, ", "),
+			},
+		})
+		h.sendMessage(cmd.ChatJID, msg)
+		return
+	}
+
+	if err := h.DB.SetChatModel(cmd.HistoryJID, model); err != nil {
+		errorMsg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "settings_save_failed"})
+		h.sendMessage(cmd.ChatJID, errorMsg)
+		return
+	}
+
+	if model == "" {
+		model = h.Gemini.DefaultModel()
+	}
+	msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+		MessageID:    "model_updated",
+		TemplateData: map[string]string{"Model": model},
+	})
+	h.sendMessage(cmd.ChatJID, msg)
+	log.Printf("Model for %s set to %s", cmd.HistoryJID, model)
+}
+
+func (h *BotHandler) handleParamsCommand(cmd *CommandContext) {
+	name := strings.ToLower(cmd.Arg(0))
+	column, ok := chatParams[name]
+	if !ok {
+		h.sendParamsUsage(cmd)
+		return
+	}
+
+	var value any
+	raw := strings.ToLower(cmd.Arg(1))
+	switch {
+	case raw == "default":
+		value = nil
+	case column == "max_output_tokens":
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			h.sendParamsUsage(cmd)
+			return
+		}
+		value = n
+	default:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil || f < 0 || (column == "top_p" && f > 1) || f > 2 {
+			h.sendParamsUsage(cmd)
+			return
+		}
+		value = f
+	}
+
+	if err := h.DB.SetChatParam(cmd.HistoryJID, column, value); err != nil {
+		errorMsg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "settings_save_failed"})
+		h.sendMessage(cmd.ChatJID, errorMsg)
+		return
+	}
+
+	msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+		MessageID:    "params_updated",
+		TemplateData: map[string]string{"Param": name, "Value": raw},
+	})
+	h.sendMessage(cmd.ChatJID, msg)
+	log.Printf("Parameter %s for %s set to %s", name, cmd.HistoryJID, raw)
+}
+
+func (h *BotHandler) sendParamsUsage(cmd *CommandContext) {
+	msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "params_usage"})
+	h.sendMessage(cmd.ChatJID, msg)
+}
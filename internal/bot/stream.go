@@ -0,0 +1,82 @@
+package bot
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// streamEditInterval is the minimum time between two edits of a streamed
+// reply. WhatsApp rate-limits rapid edits of the same message.
+const streamEditInterval = 1500 * time.Millisecond
+
+// streamReply shows a reply that is still being generated by sending a
+// placeholder message and editing it as more text arrives.
+type streamReply struct {
+	h         *BotHandler
+	chatJID   types.JID
+	messageID types.MessageID
+	lastEdit  time.Time
+	lastText  string
+	mu        sync.Mutex
+}
+
+func (h *BotHandler) newStreamReply(chatJID types.JID, placeholder string) *streamReply {
+	s := &streamReply{h: h, chatJID: chatJID}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := h.whatsApp().SendMessage(ctx, chatJID, &proto.Message{Conversation: &placeholder})
+	if err != nil {
+		log.Printf("Failed to send stream placeholder to %s: %v", chatJID, err)
+		return s
+	}
+	s.messageID = resp.ID
+	s.lastEdit = time.Now()
+	s.lastText = placeholder
+	return s
+}
+
+// update edits the reply with text unless the last edit was too recent.
+func (s *streamReply) update(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.messageID == "" || time.Since(s.lastEdit) < streamEditInterval {
+		return
+	}
+	s.edit(text)
+}
+
+// finish writes the final text. If the placeholder could not be sent the
+// text is delivered as a normal message instead.
+func (s *streamReply) finish(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.messageID == "" {
+		s.h.sendMessage(s.chatJID, text)
+		return
+	}
+	s.edit(text)
+}
+
+func (s *streamReply) edit(text string) {
+	if text == s.lastText {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	edit := s.h.whatsApp().BuildEdit(s.chatJID, s.messageID, &proto.Message{Conversation: &text})
+	if _, err := s.h.whatsApp().SendMessage(ctx, s.chatJID, edit); err != nil {
+		log.Printf("Failed to edit streamed reply in %s: %v", s.chatJID, err)
+		return
+	}
+	s.lastEdit = time.Now()
+	s.lastText = text
+}
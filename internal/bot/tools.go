@@ -0,0 +1,89 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	geminiClient "gemini-whatsapp-bot/pkg/gemini"
+
+	"github.com/google/generative-ai-go/genai"
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// geminiTools builds the functions Gemini may call while answering a message
+// in chatJID. Tools that depend on unset configuration are left out so the
+// model never offers them.
+func (h *BotHandler) geminiTools(chatJID types.JID, senderJID string, localizer *goi18n.Localizer) *geminiClient.ToolRegistry {
+	tools := geminiClient.NewToolRegistry()
+	settings := h.settings()
+
+	if settings.StoreLatitude != 0 && settings.StoreLongitude != 0 {
+		tools.Register(&genai.FunctionDeclaration{
+			Name:        "send_store_location",
+			Description: "Send the store location pin to the user. Use it when the user asks where the store is or how to get there.",
+		}, func(ctx context.Context, args map[string]any) (map[string]any, error) {
+			h.sendLocation(chatJID, localizer)
+			return map[string]any{"status": "sent", "name": settings.StoreName, "address": settings.StoreAddress}, nil
+		})
+	}
+
+	if len(settings.MenuImagePaths) > 0 || settings.MenuPDFPath != "" {
+		tools.Register(&genai.FunctionDeclaration{
+			Name:        "send_menu",
+			Description: "Send the menu images and PDF to the user. Use it when the user asks about the menu, products or prices.",
+		}, func(ctx context.Context, args map[string]any) (map[string]any, error) {
+			h.sendMenu(chatJID, localizer)
+			return map[string]any{"status": "sent"}, nil
+		})
+	}
+
+	if settings.OrderStatusURL != "" {
+		tools.Register(&genai.FunctionDeclaration{
+			Name:        "lookup_order",
+			Description: "Look up the status of one of the user's orders. Use it when the user asks where their order is or whether it has shipped.",
+			Parameters: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"order_id": {
+						Type:        genai.TypeString,
+						Description: "The order number the user gave.",
+					},
+				},
+				Required: []string{"order_id"},
+			},
+		}, func(ctx context.Context, args map[string]any) (map[string]any, error) {
+			orderID, _ := args["order_id"].(string)
+			return lookupOrder(ctx, settings.OrderStatusURL, orderID, normalizeUser(senderJID))
+		})
+	}
+
+	tools.Register(&genai.FunctionDeclaration{
+		Name:        "set_language",
+		Description: "Change the language the bot uses for its own messages to this user.",
+		Parameters: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"language": {
+					Type:        genai.TypeString,
+					Description: "Language code.",
+					Enum:        supportedLanguages,
+				},
+			},
+			Required: []string{"language"},
+		},
+	}, func(ctx context.Context, args map[string]any) (map[string]any, error) {
+		lang, _ := args["language"].(string)
+		lang = strings.ToLower(lang)
+		if !isSupportedLanguage(lang) {
+			return nil, fmt.Errorf("unsupported language %q", lang)
+		}
+		if err := h.DB.SetUserLang(senderJID, lang); err != nil {
+			return nil, err
+		}
+		return map[string]any{"status": "updated", "language": lang}, nil
+	})
+
+	return tools
+}
@@ -0,0 +1,165 @@
+package bot
+
+import (
+	"log"
+	"regexp"
+	"strings"
+
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mau.fi/whatsmeow/binary/proto"
+)
+
+// Trigger modes decide which group messages the bot answers. Trigger
+// commands such as /ask work in every mode.
+const (
+	// triggerModeCommand answers only trigger commands.
+	triggerModeCommand = "command"
+	// triggerModeMention also answers @-mentions of the bot and replies to
+	// its messages. It is the default.
+	triggerModeMention = "mention"
+	// triggerModeKeyword also answers messages containing a trigger keyword.
+	triggerModeKeyword = "keyword"
+	// triggerModeAll answers every message.
+	triggerModeAll = "all"
+)
+
+var triggerModes = []string{triggerModeCommand, triggerModeMention, triggerModeKeyword, triggerModeAll}
+
+// triggerPrompt decides whether a message is addressed to the bot and
+// returns the prompt with the trigger removed. Direct messages are always
+// addressed to the bot; group messages depend on the group's trigger mode.
+func (h *BotHandler) triggerPrompt(text string, ci *proto.ContextInfo, quote *quotedMessage, historyJID string, isGroup bool) (string, bool) {
+	text = strings.TrimSpace(text)
+	if prompt, ok := h.Commands.TriggerPrompt(text); ok {
+		return h.stripOwnMentions(prompt), true
+	}
+	if !isGroup {
+		return h.stripOwnMentions(text), true
+	}
+
+	mode := h.triggerMode(historyJID)
+	switch {
+	case mode == triggerModeAll:
+		return h.stripOwnMentions(text), true
+	case mode == triggerModeCommand:
+		return "", false
+	case h.mentionsBot(ci):
+		return h.stripOwnMentions(text), true
+	case quote.repliesToBot():
+		return text, true
+	case mode == triggerModeKeyword && h.hasTriggerKeyword(text):
+		return text, true
+	}
+	return "", false
+}
+
+// triggerMode returns the trigger mode of a group.
+func (h *BotHandler) triggerMode(historyJID string) string {
+	if mode := h.DB.GetChatSettings(historyJID).TriggerMode; mode != "" {
+		return mode
+	}
+	return triggerModeMention
+}
+
+// mentionsBot reports whether the bot's own account is among the JIDs
+// @-mentioned in the message.
+func (h *BotHandler) mentionsBot(ci *proto.ContextInfo) bool {
+	for _, jid := range ci.GetMentionedJID() {
+		if h.isOwnJID(jid) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripOwnMentions removes "@<number>" mentions of the bot from text. The
+// mention is written with the phone number or, in newer groups, the LID.
+func (h *BotHandler) stripOwnMentions(text string) string {
+	var users []string
+	if id := h.Client.Store.ID; id != nil {
+		users = append(users, id.User)
+	}
+	if lid := h.Client.Store.GetLID(); !lid.IsEmpty() {
+		users = append(users, lid.User)
+	}
+	for _, user := range users {
+		text = strings.ReplaceAll(text, "@"+user, "")
+	}
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// hasTriggerKeyword reports whether text contains one of the configured
+// trigger keywords as a whole word, ignoring case.
+func (h *BotHandler) hasTriggerKeyword(text string) bool {
+	for _, keyword := range h.settings().TriggerKeywords {
+		pattern := `(?i)(^|\W)` + regexp.QuoteMeta(keyword) + `($|\W)`
+		if matched, _ := regexp.MatchString(pattern, text); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// messageText returns the text or caption of msg.
+func messageText(msg *proto.Message) string {
+	switch {
+	case msg.GetConversation() != "":
+		return msg.GetConversation()
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetText()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetCaption()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetCaption()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetCaption()
+	}
+	return ""
+}
+
+func (h *BotHandler) handleTriggerCommand(cmd *CommandContext) {
+	mode := strings.ToLower(cmd.Arg(0))
+
+	if mode == "" {
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID: "trigger_mode_current",
+			TemplateData: map[string]string{
+				"Mode":     h.triggerMode(cmd.HistoryJID),
+				"Modes":    strings.Join(triggerModes, ", "),
+				"Keywords": strings.Join(h.settings().TriggerKeywords, ", "),
+			},
+		})
+		h.sendMessage(cmd.ChatJID, msg)
+		return
+	}
+
+	valid := false
+	for _, m := range triggerModes {
+		valid = valid || m == mode
+	}
+	if !valid {
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID:    "trigger_mode_invalid",
+			TemplateData: map[string]string{"Mode": mode, "Modes": strings.Join(triggerModes, ", ")},
+		})
+		h.sendMessage(cmd.ChatJID, msg)
+		return
+	}
+
+	stored := mode
+	if mode == triggerModeMention {
+		stored = ""
+	}
+	if err := h.DB.SetChatTriggerMode(cmd.HistoryJID, stored); err != nil {
+		errorMsg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "settings_save_failed"})
+		h.sendMessage(cmd.ChatJID, errorMsg)
+		return
+	}
+
+	msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+		MessageID:    "trigger_mode_updated",
+		TemplateData: map[string]string{"Mode": mode},
+	})
+	h.sendMessage(cmd.ChatJID, msg)
+	log.Printf("Trigger mode for %s set to %s", cmd.HistoryJID, mode)
+}
@@ -0,0 +1,301 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gemini-whatsapp-bot/internal/db"
+	geminiClient "gemini-whatsapp-bot/pkg/gemini"
+
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mau.fi/whatsmeow/types"
+)
+
+const (
+	// defaultUsageDays is the period /usage reports on when none is given.
+	defaultUsageDays = 7
+	// usageTopN is how many users and groups the report lists.
+	usageTopN = 10
+)
+
+// recordUsage stores the tokens a request in chat was billed for and charges
+// them to the daily quota of senderJID. estimate is charged instead when the
+// API reported no usage. An empty senderJID is a request the bot made on its
+// own, such as a history summary.
+func (h *BotHandler) recordUsage(chat, senderJID string, result *geminiClient.Result, estimate int) {
+	sender := ""
+	if senderJID != "" {
+		sender = quotaKey(senderJID)
+	}
+	addUsage(h.DB, db.UsageChat, chat, sender, result)
+
+	if senderJID == "" {
+		return
+	}
+	tokens := result.Usage.TotalTokens
+	if tokens == 0 {
+		tokens = estimate
+	}
+	h.recordTokens(senderJID, tokens)
+}
+
+// RecordIndexUsage stores the tokens of a request made to index the
+// knowledge documents.
+func RecordIndexUsage(database *db.Database, result *geminiClient.Result) {
+	addUsage(database, db.UsageIndex, "", "", result)
+}
+
+func addUsage(database *db.Database, kind, chat, sender string, result *geminiClient.Result) {
+	day, _ := quotaDay(time.Now())
+	database.AddTokenUsage(db.TokenUsage{
+		Day:             day,
+		Kind:            kind,
+		ChatJID:         chat,
+		SenderJID:       sender,
+		Model:           result.Model,
+		KeyIndex:        result.KeyIndex,
+		PromptTokens:    int64(result.Usage.PromptTokens),
+		CandidateTokens: int64(result.Usage.CandidateTokens),
+		TotalTokens:     int64(result.Usage.TotalTokens),
+	})
+}
+
+// usageSum is the usage of one row of a report.
+type usageSum struct {
+	Name     string
+	Requests int64
+	Tokens   int64
+	Cost     float64
+}
+
+func (s *usageSum) add(t db.UsageTotal, cost float64) {
+	s.Requests += t.Requests
+	s.Tokens += t.TotalTokens
+	s.Cost += cost
+}
+
+// usageCost returns the estimated cost of t and whether its model has a
+// price.
+func (h *BotHandler) usageCost(t db.UsageTotal) (float64, bool) {
+	price, ok := geminiClient.PriceFor(h.settings().ModelPrices, t.Model)
+	if !ok {
+		return 0, false
+	}
+	return price.Cost(t.PromptTokens, t.TotalTokens), true
+}
+
+// usagePeriod returns the first and last day of the days ending today.
+func usagePeriod(days int) (string, string) {
+	now := time.Now()
+	to, _ := quotaDay(now)
+	from, _ := quotaDay(now.AddDate(0, 0, 1-days))
+	return from, to
+}
+
+func (h *BotHandler) handleUsageCommand(cmd *CommandContext) {
+	export := strings.EqualFold(cmd.Arg(0), "export")
+	daysArg := cmd.Arg(0)
+	if export {
+		daysArg = cmd.Arg(1)
+	}
+	days := defaultUsageDays
+	if daysArg != "" {
+		n, err := strconv.Atoi(daysArg)
+		if err != nil || n < 1 {
+			msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+				MessageID:    "command_usage",
+				TemplateData: map[string]string{"Usage": "/usage [export] [days]"},
+			})
+			h.sendMessage(cmd.ChatJID, msg)
+			return
+		}
+		days = n
+	}
+
+	from, to := usagePeriod(days)
+	totals, err := h.DB.GetUsageTotals(from, to)
+	if err != nil {
+		log.Printf("Failed to read token usage: %v", err)
+		errorMsg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "usage_failed"})
+		h.sendMessage(cmd.ChatJID, errorMsg)
+		return
+	}
+	if len(totals) == 0 {
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID:    "usage_empty",
+			TemplateData: map[string]string{"From": from, "To": to},
+		})
+		h.sendMessage(cmd.ChatJID, msg)
+		return
+	}
+
+	if export {
+		h.sendUsageExport(cmd, totals, from, to)
+		return
+	}
+	h.sendMessage(cmd.ChatJID, h.usageReport(cmd.Localizer, totals, from, to))
+}
+
+// usageReport renders totals per day, per user and per group, and what
+// indexing the knowledge documents used.
+func (h *BotHandler) usageReport(localizer *goi18n.Localizer, totals []db.UsageTotal, from, to string) string {
+	var all, index usageSum
+	byDay := make(map[string]*usageSum)
+	byUser := make(map[string]*usageSum)
+	byGroup := make(map[string]*usageSum)
+	unpriced := make(map[string]bool)
+
+	sum := func(m map[string]*usageSum, key string) *usageSum {
+		if m[key] == nil {
+			m[key] = &usageSum{Name: key}
+		}
+		return m[key]
+	}
+	for _, t := range totals {
+		cost, ok := h.usageCost(t)
+		if !ok {
+			unpriced[t.Model] = true
+		}
+		all.add(t, cost)
+		if t.Kind == db.UsageIndex {
+			index.add(t, cost)
+		}
+		sum(byDay, t.Day).add(t, cost)
+		if t.SenderJID != "" {
+			sum(byUser, t.SenderJID).add(t, cost)
+		}
+		if strings.HasSuffix(t.ChatJID, "@"+types.GroupServer) {
+			sum(byGroup, t.ChatJID).add(t, cost)
+		}
+	}
+
+	line := func(s *usageSum) string {
+		msg, _ := localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID: "usage_line",
+			TemplateData: map[string]string{
+				"Name":     s.Name,
+				"Requests": strconv.FormatInt(s.Requests, 10),
+				"Tokens":   strconv.FormatInt(s.Tokens, 10),
+				"Cost":     fmt.Sprintf("%.4f", s.Cost),
+			},
+		})
+		return "\n" + msg
+	}
+	section := func(sb *strings.Builder, messageID string, rows []*usageSum) {
+		if len(rows) == 0 {
+			return
+		}
+		header, _ := localizer.Localize(&goi18n.LocalizeConfig{MessageID: messageID})
+		sb.WriteString("\n\n" + header)
+		for _, row := range rows {
+			sb.WriteString(line(row))
+		}
+	}
+
+	var sb strings.Builder
+	header, _ := localizer.Localize(&goi18n.LocalizeConfig{
+		MessageID:    "usage_header",
+		TemplateData: map[string]string{"From": from, "To": to},
+	})
+	sb.WriteString(header)
+	all.Name, _ = localizer.Localize(&goi18n.LocalizeConfig{MessageID: "usage_total"})
+	sb.WriteString(line(&all))
+	if index.Requests > 0 {
+		index.Name, _ = localizer.Localize(&goi18n.LocalizeConfig{MessageID: "usage_indexing"})
+		sb.WriteString(line(&index))
+	}
+
+	days := sortedSums(byDay)
+	sort.Slice(days, func(i, j int) bool { return days[i].Name < days[j].Name })
+	section(&sb, "usage_per_day", days)
+	section(&sb, "usage_per_user", topSums(byUser))
+	groups := topSums(byGroup)
+	for _, g := range groups {
+		if jid, err := types.ParseJID(g.Name); err == nil {
+			if name := h.groupName(jid); name != "" {
+				g.Name = name + " (" + g.Name + ")"
+			}
+		}
+	}
+	section(&sb, "usage_per_group", groups)
+
+	if len(unpriced) > 0 {
+		var models []string
+		for model := range unpriced {
+			models = append(models, model)
+		}
+		sort.Strings(models)
+		note, _ := localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID:    "usage_unpriced",
+			TemplateData: map[string]string{"Models": strings.Join(models, ", ")},
+		})
+		sb.WriteString("\n\n" + note)
+	}
+	return sb.String()
+}
+
+func sortedSums(m map[string]*usageSum) []*usageSum {
+	sums := make([]*usageSum, 0, len(m))
+	for _, s := range m {
+		sums = append(sums, s)
+	}
+	return sums
+}
+
+// topSums returns the usageTopN sums with the most tokens.
+func topSums(m map[string]*usageSum) []*usageSum {
+	sums := sortedSums(m)
+	sort.Slice(sums, func(i, j int) bool {
+		if sums[i].Tokens != sums[j].Tokens {
+			return sums[i].Tokens > sums[j].Tokens
+		}
+		return sums[i].Name < sums[j].Name
+	})
+	if len(sums) > usageTopN {
+		sums = sums[:usageTopN]
+	}
+	return sums
+}
+
+// sendUsageExport sends totals as a CSV file with one row per day, kind,
+// chat, sender and model.
+func (h *BotHandler) sendUsageExport(cmd *CommandContext, totals []db.UsageTotal, from, to string) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"day", "kind", "chat", "chat_type", "sender", "model", "requests", "prompt_tokens", "candidate_tokens", "total_tokens", "cost_usd"})
+	for _, t := range totals {
+		chatType := ""
+		switch {
+		case strings.HasSuffix(t.ChatJID, "@"+types.GroupServer):
+			chatType = "group"
+		case t.ChatJID != "":
+			chatType = "private"
+		}
+		cost := ""
+		if c, ok := h.usageCost(t); ok {
+			cost = strconv.FormatFloat(c, 'f', 6, 64)
+		}
+		w.Write([]string{
+			t.Day, t.Kind, t.ChatJID, chatType, t.SenderJID, t.Model,
+			strconv.FormatInt(t.Requests, 10),
+			strconv.FormatInt(t.PromptTokens, 10),
+			strconv.FormatInt(t.CandidateTokens, 10),
+			strconv.FormatInt(t.TotalTokens, 10),
+			cost,
+		})
+	}
+	w.Flush()
+
+	fileName := fmt.Sprintf("usage-%s-%s.csv", from, to)
+	if err := h.sendDocumentData(cmd.ChatJID, buf.Bytes(), fileName, "text/csv"); err != nil {
+		log.Printf("Failed to send usage export to %s: %v", cmd.ChatJID, err)
+		errorMsg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "usage_failed"})
+		h.sendMessage(cmd.ChatJID, errorMsg)
+	}
+}
@@ -0,0 +1,196 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gemini-whatsapp-bot/internal/tts"
+	geminiClient "gemini-whatsapp-bot/pkg/gemini"
+
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Voice modes select what the bot does with a voice note.
+const (
+	voiceModeText       = "text"
+	voiceModeTranscribe = "transcribe"
+	voiceModeVoice      = "voice"
+)
+
+var voiceModes = []string{voiceModeText, voiceModeTranscribe, voiceModeVoice}
+
+const voiceNoteInstruction = "The user sent a voice note. Listen to it and reply to what they said as if they had typed it. Do not describe the recording itself."
+
+const transcribePrompt = "Transcribe this voice note word for word in the language it is spoken. Reply with the transcript only."
+
+// ttsTimeout bounds how long a voice reply may take to synthesize.
+const ttsTimeout = time.Minute
+
+func (h *BotHandler) handleAudioMessage(audio *proto.AudioMessage, quote *quotedMessage, chatJID types.JID, senderJID string, historyJID string, userName string, localizer *goi18n.Localizer) {
+	log.Printf("Processing audio message from %s", senderJID)
+
+	h.runQueued(chatJID, localizer, func() {
+		h.processVoiceNote(audio, quote, chatJID, senderJID, historyJID, userName, localizer)
+	})
+}
+
+// processVoiceNote answers or transcribes a voice note depending on the
+// voice mode of the chat.
+func (h *BotHandler) processVoiceNote(audio *proto.AudioMessage, quote *quotedMessage, chatJID types.JID, senderJID string, historyJID string, userName string, localizer *goi18n.Localizer) {
+	audioData, err := h.whatsApp().Download(context.Background(), audio)
+	if err != nil {
+		log.Printf("Failed to download audio from %s: %v", senderJID, err)
+		return
+	}
+
+	mimeType := audio.GetMimetype()
+	if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	if mimeType == "" {
+		mimeType = "audio/ogg"
+	}
+
+	mode := h.DB.GetChatSettings(historyJID).VoiceMode
+	if mode == voiceModeTranscribe {
+		h.transcribeVoiceNote(audioData, mimeType, chatJID, senderJID, historyJID, userName, localizer)
+		return
+	}
+
+	media, err := h.saveMedia(audioData, mimeType)
+	if err != nil {
+		log.Printf("Failed to store audio from %s: %v", senderJID, err)
+		media = &storedMedia{MIMEType: mimeType, Data: audioData}
+	}
+
+	h.answerTurn(userTurn{
+		Prompt:       "[Voice note]",
+		HistoryText:  "[User sent a voice note]",
+		Media:        media,
+		Quote:        quote,
+		Instructions: []string{voiceNoteInstruction},
+		SpokenReply:  mode == voiceModeVoice,
+	}, chatJID, senderJID, historyJID, userName, localizer)
+}
+
+func (h *BotHandler) transcribeVoiceNote(audioData []byte, mimeType string, chatJID types.JID, senderJID string, historyJID string, userName string, localizer *goi18n.Localizer) {
+	h.whatsApp().SendChatPresence(chatJID, types.ChatPresenceComposing, types.ChatPresenceMediaText)
+	defer h.whatsApp().SendChatPresence(chatJID, types.ChatPresencePaused, types.ChatPresenceMediaText)
+
+	result, err := h.Gemini.GenerateContentWithMedia(transcribePrompt, mimeType, audioData, h.geminiOptions(historyJID))
+	if err != nil {
+		log.Printf("Error transcribing voice note from %s: %v", senderJID, err)
+		errorMsg, _ := localizer.Localize(&goi18n.LocalizeConfig{MessageID: "error_gemini"})
+		h.sendMessage(chatJID, errorMsg)
+		return
+	}
+
+	h.sendMessage(chatJID, result.Text)
+	h.recordUsage(chatJID.String(), senderJID, result, mediaSizeTokens(int64(len(audioData)), mimeType)+geminiClient.EstimateTokens(transcribePrompt+result.Text))
+	// The transcript is what the bot replied, so it is stored as the model
+	// turn and history keeps alternating between the user and the model.
+	h.DB.AddMessageToHistory(historyJID, "user", "[User sent a voice note to transcribe]", userName)
+	h.DB.AddModelReplyToHistory(historyJID, result.Text, result.Model)
+}
+
+// sendSpokenReply sends text as a voice note spoken by synth, falling back to
+// a text message when speech synthesis fails.
+func (h *BotHandler) sendSpokenReply(synth tts.Synthesizer, recipient types.JID, text, language string) {
+	ctx, cancel := context.WithTimeout(context.Background(), ttsTimeout)
+	defer cancel()
+
+	audio, err := synth.Synthesize(ctx, text, language)
+	if err == nil {
+		err = h.sendVoiceNote(recipient, audio)
+	}
+	if err != nil {
+		log.Printf("Failed to send spoken reply to %s, sending text instead: %v", recipient, err)
+		h.sendMessage(recipient, text)
+	}
+}
+
+func (h *BotHandler) sendVoiceNote(recipient types.JID, data []byte) error {
+	uploaded, err := h.whatsApp().Upload(context.Background(), data, whatsmeow.MediaAudio)
+	if err != nil {
+		return fmt.Errorf("upload audio: %w", err)
+	}
+
+	mimetype := "audio/ogg; codecs=opus"
+	ptt := true
+	msg := &proto.Message{
+		AudioMessage: &proto.AudioMessage{
+			Mimetype:      &mimetype,
+			PTT:           &ptt,
+			URL:           &uploaded.URL,
+			DirectPath:    &uploaded.DirectPath,
+			MediaKey:      uploaded.MediaKey,
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    &uploaded.FileLength,
+		},
+	}
+
+	_, err = h.whatsApp().SendMessage(context.Background(), recipient, msg)
+	if err != nil {
+		return fmt.Errorf("send audio: %w", err)
+	}
+	log.Printf("Sent voice note to %s", recipient)
+	return nil
+}
+
+func (h *BotHandler) handleVoiceCommand(cmd *CommandContext) {
+	mode := strings.ToLower(cmd.Arg(0))
+
+	if mode == "" {
+		current := h.DB.GetChatSettings(cmd.HistoryJID).VoiceMode
+		if current == "" {
+			current = voiceModeText
+		}
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID:    "voice_mode_current",
+			TemplateData: map[string]string{"Mode": current, "Modes": strings.Join(voiceModes, ", ")},
+		})
+		h.sendMessage(cmd.ChatJID, msg)
+		return
+	}
+
+	switch mode {
+	case voiceModeText, voiceModeTranscribe:
+	case voiceModeVoice:
+		if h.settings().TTS == nil {
+			msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "voice_not_configured"})
+			h.sendMessage(cmd.ChatJID, msg)
+			return
+		}
+	default:
+		msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+			MessageID:    "voice_mode_invalid",
+			TemplateData: map[string]string{"Mode": mode, "Modes": strings.Join(voiceModes, ", ")},
+		})
+		h.sendMessage(cmd.ChatJID, msg)
+		return
+	}
+
+	stored := mode
+	if mode == voiceModeText {
+		stored = ""
+	}
+	if err := h.DB.SetChatVoiceMode(cmd.HistoryJID, stored); err != nil {
+		errorMsg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{MessageID: "settings_save_failed"})
+		h.sendMessage(cmd.ChatJID, errorMsg)
+		return
+	}
+
+	msg, _ := cmd.Localizer.Localize(&goi18n.LocalizeConfig{
+		MessageID:    "voice_mode_updated",
+		TemplateData: map[string]string{"Mode": mode},
+	})
+	h.sendMessage(cmd.ChatJID, msg)
+	log.Printf("Voice mode for %s set to %s", cmd.HistoryJID, mode)
+}
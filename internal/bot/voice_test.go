@@ -0,0 +1,174 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"gemini-whatsapp-bot/internal/db"
+	geminiClient "gemini-whatsapp-bot/pkg/gemini"
+
+	"github.com/google/generative-ai-go/genai"
+	goi18n "github.com/nicksnyder/go-i18n/v2/i18n"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"golang.org/x/text/language"
+)
+
+// stubMessenger hands out a fixed download and records what is sent.
+type stubMessenger struct {
+	download []byte
+
+	mu       sync.Mutex
+	sent     []*proto.Message
+	uploaded [][]byte
+}
+
+func (m *stubMessenger) SendMessage(ctx context.Context, to types.JID, message *proto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, message)
+	return whatsmeow.SendResponse{}, nil
+}
+
+func (m *stubMessenger) BuildEdit(chat types.JID, id types.MessageID, newContent *proto.Message) *proto.Message {
+	return newContent
+}
+
+func (m *stubMessenger) SendChatPresence(jid types.JID, state types.ChatPresence, media types.ChatPresenceMedia) error {
+	return nil
+}
+
+func (m *stubMessenger) Download(ctx context.Context, msg whatsmeow.DownloadableMessage) ([]byte, error) {
+	return m.download, nil
+}
+
+func (m *stubMessenger) Upload(ctx context.Context, plaintext []byte, appInfo whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploaded = append(m.uploaded, plaintext)
+	return whatsmeow.UploadResponse{URL: "https://example.invalid/audio", FileLength: uint64(len(plaintext))}, nil
+}
+
+func (m *stubMessenger) GetGroupInfo(jid types.JID) (*types.GroupInfo, error) {
+	return &types.GroupInfo{}, nil
+}
+
+// stubGenerator answers chats with reply and transcriptions with transcript,
+// and records the media it was sent.
+type stubGenerator struct {
+	reply      string
+	transcript string
+	media      [][]byte
+}
+
+func (g *stubGenerator) DefaultModel() string { return "gemini-test" }
+
+func (g *stubGenerator) GenerateContentWithTools(history []*genai.Content, tools *geminiClient.ToolRegistry, opts geminiClient.Options) (*geminiClient.Result, error) {
+	for _, part := range history[len(history)-1].Parts {
+		if blob, ok := part.(genai.Blob); ok {
+			g.media = append(g.media, blob.Data)
+		}
+	}
+	return &geminiClient.Result{Text: g.reply, Model: "gemini-test"}, nil
+}
+
+func (g *stubGenerator) GenerateContentStream(history []*genai.Content, tools *geminiClient.ToolRegistry, opts geminiClient.Options, onChunk geminiClient.StreamFunc) (*geminiClient.Result, error) {
+	return g.GenerateContentWithTools(history, tools, opts)
+}
+
+func (g *stubGenerator) GenerateContentWithMedia(prompt string, mimeType string, data []byte, opts geminiClient.Options) (*geminiClient.Result, error) {
+	g.media = append(g.media, data)
+	return &geminiClient.Result{Text: g.transcript, Model: "gemini-test"}, nil
+}
+
+func (g *stubGenerator) KeyStats() []geminiClient.KeyStats { return nil }
+
+// stubSynthesizer speaks every text as the same audio.
+type stubSynthesizer struct {
+	audio []byte
+	texts []string
+}
+
+func (s *stubSynthesizer) Synthesize(ctx context.Context, text, language string) ([]byte, error) {
+	s.texts = append(s.texts, text)
+	return s.audio, nil
+}
+
+func TestVoiceModes(t *testing.T) {
+	voiceNote, err := os.ReadFile(filepath.Join("testdata", "voice_note.ogg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spoken := []byte("OggS spoken reply")
+
+	tests := []struct {
+		mode      string
+		wantText  string
+		wantVoice bool
+		wantModel string
+	}{
+		{mode: voiceModeText, wantText: "We open at 8.", wantModel: "We open at 8."},
+		{mode: voiceModeTranscribe, wantText: "What time do you open?", wantModel: "What time do you open?"},
+		{mode: voiceModeVoice, wantVoice: true, wantModel: "We open at 8."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			database := db.New(filepath.Join(t.TempDir(), "bot.db"))
+			t.Cleanup(func() { database.Close() })
+			database.InitSchema()
+
+			wa := &stubMessenger{download: voiceNote}
+			gemini := &stubGenerator{reply: "We open at 8.", transcript: "What time do you open?"}
+			synth := &stubSynthesizer{audio: spoken}
+			h := &BotHandler{DB: database, Gemini: gemini, MediaDir: t.TempDir(), wa: wa}
+			h.SetSettings(&Settings{TTS: synth})
+
+			sender := types.NewJID("6281111111111", types.DefaultUserServer)
+			if tt.mode != voiceModeText {
+				if err := database.SetChatVoiceMode(sender.String(), tt.mode); err != nil {
+					t.Fatal(err)
+				}
+			}
+			localizer := goi18n.NewLocalizer(goi18n.NewBundle(language.English), "en")
+			mimetype := "audio/ogg; codecs=opus"
+			h.processVoiceNote(&proto.AudioMessage{Mimetype: &mimetype}, nil, sender, sender.String(), sender.String(), "Ann", localizer)
+
+			if len(gemini.media) != 1 || !bytes.Equal(gemini.media[0], voiceNote) {
+				t.Fatalf("Gemini got %d media parts, want the voice note", len(gemini.media))
+			}
+			if len(wa.sent) != 1 {
+				t.Fatalf("sent %d messages, want 1", len(wa.sent))
+			}
+			reply := wa.sent[0]
+			if tt.wantVoice {
+				audio := reply.GetAudioMessage()
+				if audio == nil || !audio.GetPTT() {
+					t.Fatalf("sent %v, want a voice note", reply)
+				}
+				if len(wa.uploaded) != 1 || !bytes.Equal(wa.uploaded[0], spoken) {
+					t.Errorf("uploaded %d files, want the synthesized reply", len(wa.uploaded))
+				}
+				if len(synth.texts) != 1 || synth.texts[0] != "We open at 8." {
+					t.Errorf("synthesized %q, want the reply", synth.texts)
+				}
+			} else {
+				if reply.GetConversation() != tt.wantText {
+					t.Errorf("sent %v, want the text %q", reply, tt.wantText)
+				}
+				if len(synth.texts) != 0 {
+					t.Errorf("synthesized %q in %s mode", synth.texts, tt.mode)
+				}
+			}
+
+			history := database.GetConversationHistory(sender.String(), 10)
+			if len(history) != 2 || history[0].Role != "user" || history[1].Role != "model" || history[1].Message != tt.wantModel {
+				t.Errorf("history is %+v, want the voice note followed by %q", history, tt.wantModel)
+			}
+		})
+	}
+}
@@ -1,21 +1,56 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
-	"strings"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	GeminiAPIKeys []string
-	KnowledgeEnabled bool
-	KnowledgeFile    string
-	StoreLatitude    float64
-	StoreLongitude   float64
-	MenuImagePath    string
+	GeminiAPIKeys      []string
+	KnowledgeEnabled   bool
+	KnowledgeFile      string
+	KnowledgeDocsDir   string
+	KnowledgeTopK      int
+	EmbeddingModel     string
+	StoreLatitude      float64
+	StoreLongitude     float64
+	StoreName          string
+	StoreAddress       string
+	MenuImagePaths     []string
+	MenuPDFPath        string
+	OrderStatusURL     string
+	StreamReplies      bool
+	TriggerKeywords    []string
+	OwnerJIDs          []string
+	AccessMode         string
+	AccessDeniedNotice bool
+	SenderRateLimit    int
+	SenderRateBurst    int
+	ChatRateLimit      int
+	ChatRateBurst      int
+	DailyMessageQuota  int
+	DailyTokenQuota    int
+	ModelPrices        string
+	ResponseCacheTTL   time.Duration
+	HistoryTokenBudget int
+	GeminiConcurrency  int
+	ChatQueueDepth     int
+	MediaDir           string
+	TTSCommand         string
+	GeminiModel        string
+	AvailableModels    []string
+	FallbackModels     []string
+	Temperature        *float32
+	TopP               *float32
+	MaxOutputTokens    *int32
+	SafetyThreshold    string
 }
 
 func Load() *Config {
@@ -24,31 +59,211 @@ func Load() *Config {
 		log.Println("No .env file found, reading from environment variables")
 	}
 
+	cfg, err := read()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cfg
+}
+
+// accessModes are the values ACCESS_MODE accepts.
+var accessModes = []string{"open", "allowlist", "blocklist"}
+
+// Reload reads the .env file again, letting its values replace those already
+// in the environment, and returns the new configuration. Unlike Load it
+// reports invalid configuration as an error so the caller can keep running
+// with the old one.
+func Reload() (*Config, error) {
+	if err := godotenv.Overload(); err != nil {
+		log.Println("No .env file found, reading from environment variables")
+	}
+	return read()
+}
+
+func read() (*Config, error) {
 	apiKeysStr := os.Getenv("GEMINI_API_KEYS")
 	if apiKeysStr == "" {
-		log.Fatal("GEMINI_API_KEYS is not set in .env file or environment variables")
+		return nil, errors.New("GEMINI_API_KEYS is not set in .env file or environment variables")
 	}
 
 	apiKeys := strings.Split(apiKeysStr, ",")
 	if len(apiKeys) == 0 || apiKeys[0] == "" {
-		log.Fatal("GEMINI_API_KEYS is empty or invalid")
+		return nil, errors.New("GEMINI_API_KEYS is empty or invalid")
 	}
 
 	log.Printf("Loaded %d Gemini API keys", len(apiKeys))
 
+	var env envParser
 	knowledgeEnabled := os.Getenv("KNOWLEDGE_ENABLED") == "true"
 	knowledgeFile := os.Getenv("KNOWLEDGE_FILE")
+	knowledgeDocsDir := os.Getenv("KNOWLEDGE_DOCS_DIR")
+	knowledgeTopK := env.Int("KNOWLEDGE_TOP_K", 4)
+
+	lat := env.Float64("STORE_LATITUDE")
+	lon := env.Float64("STORE_LONGITUDE")
+	storeName := os.Getenv("STORE_NAME")
+	storeAddress := os.Getenv("STORE_ADDRESS")
+	menuPaths := splitList(os.Getenv("MENU_IMAGE_PATH"))
+	menuPDFPath := os.Getenv("MENU_PDF_PATH")
+	streamReplies := os.Getenv("STREAM_REPLIES") == "true"
+	concurrency := env.Int("GEMINI_CONCURRENCY", 4)
+	queueDepth := env.Int("CHAT_QUEUE_DEPTH", 5)
+
+	model := os.Getenv("GEMINI_MODEL")
+	if model == "" {
+		model = "gemini-2.5-flash"
+	}
+	availableModels := splitList(os.Getenv("GEMINI_AVAILABLE_MODELS"))
+	if len(availableModels) == 0 {
+		availableModels = []string{"gemini-2.5-flash", "gemini-2.5-pro", "gemini-2.5-flash-lite"}
+	}
+	var maxOutputTokens *int32
+	if n := env.Int("GEMINI_MAX_OUTPUT_TOKENS", 0); n > 0 {
+		tokens := int32(n)
+		maxOutputTokens = &tokens
+	}
+
+	cfg := &Config{
+		GeminiAPIKeys:      apiKeys,
+		KnowledgeEnabled:   knowledgeEnabled,
+		KnowledgeFile:      knowledgeFile,
+		KnowledgeDocsDir:   knowledgeDocsDir,
+		KnowledgeTopK:      knowledgeTopK,
+		EmbeddingModel:     os.Getenv("EMBEDDING_MODEL"),
+		StoreLatitude:      lat,
+		StoreLongitude:     lon,
+		StoreName:          storeName,
+		StoreAddress:       storeAddress,
+		MenuImagePaths:     menuPaths,
+		MenuPDFPath:        menuPDFPath,
+		OrderStatusURL:     os.Getenv("ORDER_STATUS_URL"),
+		StreamReplies:      streamReplies,
+		TriggerKeywords:    splitList(os.Getenv("TRIGGER_KEYWORDS")),
+		OwnerJIDs:          splitList(os.Getenv("OWNER_JIDS")),
+		AccessMode:         env.OneOf("ACCESS_MODE", accessModes...),
+		AccessDeniedNotice: os.Getenv("ACCESS_DENIED_NOTICE") == "true",
+		SenderRateLimit:    env.Int("SENDER_RATE_LIMIT", 6),
+		SenderRateBurst:    env.Int("SENDER_RATE_BURST", 3),
+		ChatRateLimit:      env.Int("CHAT_RATE_LIMIT", 20),
+		ChatRateBurst:      env.Int("CHAT_RATE_BURST", 10),
+		DailyMessageQuota:  env.Int("DAILY_MESSAGE_QUOTA", 0),
+		DailyTokenQuota:    env.Int("DAILY_TOKEN_QUOTA", 0),
+		ModelPrices:        os.Getenv("MODEL_PRICES"),
+		ResponseCacheTTL:   env.Duration("RESPONSE_CACHE_TTL"),
+		HistoryTokenBudget: env.Int("HISTORY_TOKEN_BUDGET", 8000),
+		GeminiConcurrency:  concurrency,
+		ChatQueueDepth:     queueDepth,
+		MediaDir:           os.Getenv("MEDIA_DIR"),
+		TTSCommand:         os.Getenv("TTS_COMMAND"),
+		GeminiModel:        model,
+		AvailableModels:    availableModels,
+		FallbackModels:     splitList(os.Getenv("GEMINI_FALLBACK_MODELS")),
+		Temperature:        env.Float("GEMINI_TEMPERATURE"),
+		TopP:               env.Float("GEMINI_TOP_P"),
+		MaxOutputTokens:    maxOutputTokens,
+		SafetyThreshold:    os.Getenv("GEMINI_SAFETY_THRESHOLD"),
+	}
+	if err := errors.Join(env.errs...); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// splitList parses a comma-separated environment value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envParser reads typed environment variables. Unset variables get their
+// default, and invalid values are collected in errs so that every mistake in
+// .env is reported at once.
+type envParser struct {
+	errs []error
+}
+
+func (p *envParser) invalid(name, value string, err error) {
+	p.errs = append(p.errs, fmt.Errorf("invalid value for %s: %q: %w", name, value, err))
+}
+
+// Int reads an integer environment variable, returning def when it is unset.
+func (p *envParser) Int(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		p.invalid(name, value, err)
+		return def
+	}
+	return n
+}
+
+// Float reads an optional float environment variable. It returns nil when
+// the variable is unset.
+func (p *envParser) Float(name string) *float32 {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(value, 32)
+	if err != nil {
+		p.invalid(name, value, err)
+		return nil
+	}
+	f32 := float32(f)
+	return &f32
+}
+
+// Float64 reads a float environment variable, returning zero when it is
+// unset.
+func (p *envParser) Float64(name string) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		p.invalid(name, value, err)
+		return 0
+	}
+	return f
+}
 
-	lat, _ := strconv.ParseFloat(os.Getenv("STORE_LATITUDE"), 64)
-	lon, _ := strconv.ParseFloat(os.Getenv("STORE_LONGITUDE"), 64)
-	menuPath := os.Getenv("MENU_IMAGE_PATH")
+// Duration reads an optional duration environment variable such as "6h".
+// It returns zero when the variable is unset.
+func (p *envParser) Duration(name string) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		p.invalid(name, value, err)
+		return 0
+	}
+	return d
+}
 
-	return &Config{
-		GeminiAPIKeys: apiKeys,
-		KnowledgeEnabled: knowledgeEnabled,
-		KnowledgeFile:    knowledgeFile,
-		StoreLatitude:    lat,
-		StoreLongitude:   lon,
-		MenuImagePath:    menuPath,
+// OneOf reads an optional environment variable that must be one of values.
+// It returns an empty string when the variable is unset.
+func (p *envParser) OneOf(name string, values ...string) string {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv(name)))
+	if value == "" {
+		return ""
+	}
+	for _, v := range values {
+		if v == value {
+			return value
+		}
 	}
-}
\ No newline at end of file
+	p.invalid(name, value, fmt.Errorf("must be one of %s", strings.Join(values, ", ")))
+	return ""
+}
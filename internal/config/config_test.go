@@ -0,0 +1,48 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadValidConfig(t *testing.T) {
+	t.Setenv("GEMINI_API_KEYS", "key-1,key-2")
+	t.Setenv("ACCESS_MODE", "Allowlist")
+	t.Setenv("RESPONSE_CACHE_TTL", "6h")
+	t.Setenv("SENDER_RATE_LIMIT", "12")
+	t.Setenv("GEMINI_TEMPERATURE", "0.4")
+
+	cfg, err := read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AccessMode != "allowlist" || cfg.ResponseCacheTTL != 6*time.Hour || cfg.SenderRateLimit != 12 {
+		t.Errorf("got access mode %q, cache TTL %v, rate limit %d", cfg.AccessMode, cfg.ResponseCacheTTL, cfg.SenderRateLimit)
+	}
+	if cfg.Temperature == nil || *cfg.Temperature != 0.4 {
+		t.Errorf("got temperature %v, want 0.4", cfg.Temperature)
+	}
+	if cfg.ChatRateLimit != 20 {
+		t.Errorf("got chat rate limit %d, want the default 20", cfg.ChatRateLimit)
+	}
+}
+
+func TestReadRejectsInvalidValues(t *testing.T) {
+	t.Setenv("GEMINI_API_KEYS", "key-1")
+	t.Setenv("ACCESS_MODE", "friends-only")
+	t.Setenv("RESPONSE_CACHE_TTL", "6 hours")
+	t.Setenv("SENDER_RATE_LIMIT", "ten")
+	t.Setenv("GEMINI_TOP_P", "high")
+	t.Setenv("STORE_LATITUDE", "-6,2")
+
+	_, err := read()
+	if err == nil {
+		t.Fatal("expected an error for invalid values")
+	}
+	for _, name := range []string{"ACCESS_MODE", "RESPONSE_CACHE_TTL", "SENDER_RATE_LIMIT", "GEMINI_TOP_P", "STORE_LATITUDE"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q does not mention %s", err, name)
+		}
+	}
+}
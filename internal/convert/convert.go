@@ -0,0 +1,370 @@
+// Package convert extracts plain text from file formats Gemini cannot read
+// directly.
+package convert
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxEntrySize caps how much of one archive entry is decompressed, and how
+// much text a workbook yields, so that a small zip bomb cannot exhaust
+// memory. It matches the largest file sent to Gemini inline.
+const maxEntrySize = 20 << 20
+
+// maxColumns is the number of columns of an Excel sheet. Cell references
+// past it are forged and do not get padded.
+const maxColumns = 16384
+
+// errTooMuchText is returned once a workbook yields more than maxEntrySize
+// bytes of text.
+var errTooMuchText = errors.New("xlsx has too much data")
+
+// limitedWriter passes writes on to w until n bytes have been written, and
+// fails every write after that with errTooMuchText.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.n {
+		l.n = 0
+		return 0, errTooMuchText
+	}
+	l.n -= len(p)
+	return l.w.Write(p)
+}
+
+// Text returns data as a string if it is valid UTF-8 text.
+func Text(data []byte) (string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) {
+		return "", errors.New("file is not UTF-8 text")
+	}
+	return string(data), nil
+}
+
+// DOCX returns the text of a Word document, one paragraph per line.
+func DOCX(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("open docx: %w", err)
+	}
+	f, err := openZipFile(zr, "word/document.xml")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var sb strings.Builder
+	dec := xml.NewDecoder(f)
+	inText := false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("parse docx: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				sb.WriteByte('\t')
+			case "br", "cr":
+				sb.WriteByte('\n')
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				sb.WriteByte('\n')
+			}
+		case xml.CharData:
+			if inText {
+				sb.Write(t)
+			}
+		}
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
+
+// XLSX returns every sheet of an Excel workbook as CSV, in the order the
+// workbook shows them, each preceded by the sheet name.
+func XLSX(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("open xlsx: %w", err)
+	}
+
+	shared, err := sharedStrings(zr)
+	if err != nil {
+		return "", err
+	}
+
+	sheets := worksheets(zr)
+	if len(sheets) == 0 {
+		return "", errors.New("xlsx has no worksheets")
+	}
+
+	var sb strings.Builder
+	out := &limitedWriter{w: &sb, n: maxEntrySize}
+	for _, sheet := range sheets {
+		if _, err := fmt.Fprintf(out, "# %s\n", sheet.Name); err != nil {
+			return "", err
+		}
+		if err := writeSheet(out, sheet.File, shared); err != nil {
+			return "", err
+		}
+		if _, err := io.WriteString(out, "\n"); err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
+
+// worksheet is a sheet of a workbook and the archive entry holding it.
+type worksheet struct {
+	Name string
+	File *zip.File
+}
+
+// worksheets returns the sheets of a workbook in the order of its tabs. A
+// workbook without a readable sheet list falls back to the order of the
+// sheet file names.
+func worksheets(zr *zip.Reader) []worksheet {
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		if strings.HasPrefix(f.Name, "xl/worksheets/") && strings.HasSuffix(f.Name, ".xml") {
+			files[f.Name] = f
+		}
+	}
+
+	var sheets []worksheet
+	if order, err := sheetOrder(zr); err == nil {
+		for _, s := range order {
+			if f := files[s.Target]; f != nil {
+				sheets = append(sheets, worksheet{Name: s.Name, File: f})
+				delete(files, s.Target)
+			}
+		}
+	}
+
+	var rest []worksheet
+	for name, f := range files {
+		rest = append(rest, worksheet{Name: strings.TrimSuffix(path.Base(name), ".xml"), File: f})
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i].File.Name < rest[j].File.Name })
+	return append(sheets, rest...)
+}
+
+// sheetTarget is a sheet listed in xl/workbook.xml with the archive path of
+// its worksheet.
+type sheetTarget struct {
+	Name   string
+	Target string
+}
+
+// sheetOrder reads the sheet tabs of xl/workbook.xml and resolves them to
+// worksheet files through the workbook relationships.
+func sheetOrder(zr *zip.Reader) ([]sheetTarget, error) {
+	var workbook struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			ID   string `xml:"id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := decodeZipFile(zr, "xl/workbook.xml", &workbook); err != nil {
+		return nil, err
+	}
+	var rels struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := decodeZipFile(zr, "xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+
+	targets := make(map[string]string)
+	for _, r := range rels.Relationships {
+		target := strings.TrimPrefix(r.Target, "/")
+		if !strings.HasPrefix(target, "xl/") {
+			target = path.Join("xl", target)
+		}
+		targets[r.ID] = target
+	}
+	var order []sheetTarget
+	for _, s := range workbook.Sheets {
+		if target, ok := targets[s.ID]; ok {
+			order = append(order, sheetTarget{Name: s.Name, Target: target})
+		}
+	}
+	return order, nil
+}
+
+func decodeZipFile(zr *zip.Reader, name string, v any) error {
+	f, err := openZipFile(zr, name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := xml.NewDecoder(f).Decode(v); err != nil {
+		return fmt.Errorf("parse %s: %w", name, err)
+	}
+	return nil
+}
+
+func openZipFile(zr *zip.Reader, name string) (io.ReadCloser, error) {
+	for _, f := range zr.File {
+		if f.Name == name {
+			return openEntry(f)
+		}
+	}
+	return nil, fmt.Errorf("%s not found", name)
+}
+
+// openEntry opens an archive entry, reading at most maxEntrySize bytes of
+// it. The size in the entry header can be forged, so it is only used to
+// reject entries early.
+func openEntry(f *zip.File) (io.ReadCloser, error) {
+	if f.UncompressedSize64 > maxEntrySize {
+		return nil, fmt.Errorf("%s is too large", f.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, maxEntrySize), rc}, nil
+}
+
+// sharedStrings reads the string table cells of type "s" point into.
+func sharedStrings(zr *zip.Reader) ([]string, error) {
+	f, err := openZipFile(zr, "xl/sharedStrings.xml")
+	if err != nil {
+		// Workbooks without text cells have no string table.
+		return nil, nil
+	}
+	defer f.Close()
+
+	var table struct {
+		Items []struct {
+			Text string `xml:"t"`
+			Runs []struct {
+				Text string `xml:"t"`
+			} `xml:"r"`
+		} `xml:"si"`
+	}
+	if err := xml.NewDecoder(f).Decode(&table); err != nil {
+		return nil, fmt.Errorf("parse shared strings: %w", err)
+	}
+
+	strs := make([]string, len(table.Items))
+	for i, item := range table.Items {
+		text := item.Text
+		for _, run := range item.Runs {
+			text += run.Text
+		}
+		strs[i] = text
+	}
+	return strs, nil
+}
+
+// sheetRow is a <row> element of a worksheet.
+type sheetRow struct {
+	Cells []struct {
+		Ref    string `xml:"r,attr"`
+		Type   string `xml:"t,attr"`
+		Value  string `xml:"v"`
+		Inline string `xml:"is>t"`
+	} `xml:"c"`
+}
+
+// record returns the values of the row, with shared strings resolved and
+// empty fields for skipped columns.
+func (row sheetRow) record(shared []string) []string {
+	var record []string
+	for _, c := range row.Cells {
+		value := c.Value
+		switch c.Type {
+		case "s":
+			if i, err := strconv.Atoi(c.Value); err == nil && i >= 0 && i < len(shared) {
+				value = shared[i]
+			}
+		case "inlineStr":
+			value = c.Inline
+		}
+		if col := columnIndex(c.Ref); col > len(record) && col < maxColumns {
+			record = append(record, make([]string, col-len(record))...)
+		}
+		record = append(record, value)
+	}
+	return record
+}
+
+// writeSheet writes the rows of sheet to out as CSV one at a time. Cells can
+// repeat a long shared string any number of times, so the text is only
+// bounded by out and never built up in full first.
+func writeSheet(out io.Writer, sheet *zip.File, shared []string) error {
+	f, err := openEntry(sheet)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(out)
+	dec := xml.NewDecoder(f)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", sheet.Name, err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "row" {
+			continue
+		}
+		var row sheetRow
+		if err := dec.DecodeElement(&row, &start); err != nil {
+			return fmt.Errorf("parse %s: %w", sheet.Name, err)
+		}
+		if err := w.Write(row.record(shared)); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// columnIndex returns the zero-based column of a cell reference like "C7".
+func columnIndex(ref string) int {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' || col > maxColumns {
+			break
+		}
+		col = col*26 + int(r-'A'+1)
+	}
+	return col - 1
+}
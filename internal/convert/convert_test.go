@@ -0,0 +1,186 @@
+package convert
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+)
+
+func zipFiles(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sheetXML(value string) string {
+	return `<worksheet><sheetData><row><c r="A1" t="inlineStr"><is><t>` + value + `</t></is></c></row></sheetData></worksheet>`
+}
+
+func TestXLSXKeepsWorkbookOrder(t *testing.T) {
+	data := zipFiles(t, map[string]string{
+		"xl/workbook.xml": `<workbook xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>
+			<sheet name="Prices" sheetId="1" r:id="rId2"/>
+			<sheet name="Stock" sheetId="2" r:id="rId1"/>
+		</sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships>
+			<Relationship Id="rId1" Target="worksheets/sheet1.xml"/>
+			<Relationship Id="rId2" Target="/xl/worksheets/sheet2.xml"/>
+		</Relationships>`,
+		"xl/worksheets/sheet1.xml": sheetXML("stock"),
+		"xl/worksheets/sheet2.xml": sheetXML("prices"),
+	})
+
+	text, err := XLSX(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Prices\nprices\n\n# Stock\nstock"
+	if text != want {
+		t.Errorf("got %q, want %q", text, want)
+	}
+}
+
+func TestXLSXWithoutWorkbookUsesFileOrder(t *testing.T) {
+	data := zipFiles(t, map[string]string{
+		"xl/worksheets/sheet2.xml": sheetXML("second"),
+		"xl/worksheets/sheet1.xml": sheetXML("first"),
+	})
+
+	text, err := XLSX(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# sheet1\nfirst\n\n# sheet2\nsecond"; text != want {
+		t.Errorf("got %q, want %q", text, want)
+	}
+}
+
+func TestDOCXRejectsOversizedEntries(t *testing.T) {
+	body := "<w:document><w:body><w:p><w:r><w:t>" + strings.Repeat("a", maxEntrySize) + "</w:t></w:r></w:p></w:body></w:document>"
+	data := zipFiles(t, map[string]string{"word/document.xml": body})
+	if len(data) > maxEntrySize/100 {
+		t.Fatalf("test archive is %d bytes, expected it to compress well", len(data))
+	}
+
+	if _, err := DOCX(data); err == nil {
+		t.Fatal("expected an error for an entry over the size limit")
+	}
+}
+
+func TestDOCX(t *testing.T) {
+	data := zipFiles(t, map[string]string{
+		"word/document.xml": `<w:document><w:body>
+			<w:p><w:r><w:t>Opening hours</w:t></w:r></w:p>
+			<w:p><w:r><w:t>Mon</w:t><w:tab/><w:t>9-17</w:t></w:r></w:p>
+		</w:body></w:document>`,
+	})
+
+	text, err := DOCX(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Opening hours\nMon\t9-17"; text != want {
+		t.Errorf("got %q, want %q", text, want)
+	}
+}
+
+func TestXLSXStopsAtSharedStringAmplification(t *testing.T) {
+	var sheet strings.Builder
+	sheet.WriteString("<worksheet><sheetData>")
+	for i := 0; i < 64; i++ {
+		sheet.WriteString(`<row><c r="A1" t="s"><v>0</v></c></row>`)
+	}
+	sheet.WriteString("</sheetData></worksheet>")
+	data := zipFiles(t, map[string]string{
+		"xl/sharedStrings.xml":     "<sst><si><t>" + strings.Repeat("a", 1<<20) + "</t></si></sst>",
+		"xl/worksheets/sheet1.xml": sheet.String(),
+	})
+
+	if _, err := XLSX(data); err != errTooMuchText {
+		t.Fatalf("got error %v, want %v", err, errTooMuchText)
+	}
+}
+
+func TestXLSXIgnoresForgedColumns(t *testing.T) {
+	data := zipFiles(t, map[string]string{
+		"xl/worksheets/sheet1.xml": `<worksheet><sheetData><row>
+			<c r="A1" t="inlineStr"><is><t>name</t></is></c>
+			<c r="C1" t="inlineStr"><is><t>price</t></is></c>
+			<c r="ZZZZZZZZZZZZ1" t="inlineStr"><is><t>forged</t></is></c>
+		</row></sheetData></worksheet>`,
+	})
+
+	text, err := XLSX(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# sheet1\nname,,price,forged"; text != want {
+		t.Errorf("got %q, want %q", text, want)
+	}
+}
+
+func TestOpenEntryLimitsForgedSize(t *testing.T) {
+	content := []byte("<w:document><w:body><w:p><w:r><w:t>" + strings.Repeat("a", maxEntrySize) + "</w:t></w:r></w:p></w:body></w:document>")
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(content)
+	fw.Close()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "word/document.xml",
+		Method:             zip.Deflate,
+		CRC32:              crc32.ChecksumIEEE(content),
+		CompressedSize64:   uint64(compressed.Len()),
+		UncompressedSize64: maxEntrySize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(compressed.Bytes())
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := openEntry(zr.File[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	read, err := io.Copy(io.Discard, rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != maxEntrySize {
+		t.Errorf("read %d bytes, want the limit of %d", read, maxEntrySize)
+	}
+
+	if _, err := DOCX(buf.Bytes()); err == nil {
+		t.Error("expected an error for a document cut off at the size limit")
+	}
+}
@@ -3,19 +3,117 @@ package db
 import (
 	"context"
 	"database/sql"
+	"encoding/binary"
+	"fmt"
 	"log"
+	"math"
 	_ "modernc.org/sqlite"
+	"time"
 )
 
 type Database struct {
 	*sql.DB
 }
 
-type HistoryMessage struct {
-	Role    string
-	Message string
-	UserName string
+// ChatSettings holds per-chat overrides of the Gemini model and generation
+// parameters. Nil and empty fields use the bot defaults.
+type ChatSettings struct {
+	Persona         string
+	VoiceMode       string
+	TriggerMode     string
+	Model           string
+	Temperature     *float64
+	TopP            *float64
+	MaxOutputTokens *int64
+}
+
+// Persona is a named profile with its own system prompt and defaults that
+// can be bound to a chat. Empty and nil fields use the bot defaults.
+type Persona struct {
+	Name         string
+	SystemPrompt string
+	Model        string
+	Temperature  *float64
+	Language     string
+}
+
+// KnowledgeSource is an indexed document: the hash of the content its chunks
+// were made from and the embedding model that embedded them.
+type KnowledgeSource struct {
+	Hash     string
+	Embedder string
+}
+
+// KnowledgeChunk is a passage of an indexed document with its embedding.
+type KnowledgeChunk struct {
+	Source    string
+	Position  int
+	Content   string
+	Embedding []float32
+}
+
+// RoleGrant is a role given to a WhatsApp user by an owner of the bot. JID is
+// the user part of the account, e.g. the phone number.
+type RoleGrant struct {
+	JID       string
+	Role      string
+	GrantedBy string
+}
 
+// AccessRule allows or blocks a WhatsApp user in a scope, which is a group
+// JID or empty for private chats. JID is the user part of the account.
+type AccessRule struct {
+	JID     string
+	Rule    string
+	AddedBy string
+}
+
+// Kinds of request recorded in token_usage.
+const (
+	// UsageChat is a request made to answer or summarize a chat.
+	UsageChat = "chat"
+	// UsageIndex is a request made to index the knowledge documents, which
+	// belongs to no chat.
+	UsageIndex = "index"
+)
+
+// TokenUsage is one request to Gemini and the tokens it was billed for. Day
+// is the local date of the request, formatted as YYYY-MM-DD, and Kind is one
+// of the Usage kinds.
+type TokenUsage struct {
+	Day             string
+	Kind            string
+	ChatJID         string
+	SenderJID       string
+	Model           string
+	KeyIndex        int
+	PromptTokens    int64
+	CandidateTokens int64
+	TotalTokens     int64
+}
+
+// UsageTotal sums the requests of one day, kind, chat, sender and model.
+type UsageTotal struct {
+	Day             string
+	Kind            string
+	ChatJID         string
+	SenderJID       string
+	Model           string
+	Requests        int64
+	PromptTokens    int64
+	CandidateTokens int64
+	TotalTokens     int64
+}
+
+// HistoryMessage is one turn of a conversation. MediaPath and MediaMIME are
+// set when the user sent a file along with the message.
+type HistoryMessage struct {
+	ID        int64
+	Role      string
+	Message   string
+	UserName  string
+	MediaPath string
+	MediaMIME string
 }
 
 func New(dbPath string) *Database {
@@ -47,6 +145,95 @@ func (db *Database) InitSchema() {
         user_name TEXT,
         timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
     );`
+	chatSettingsQuery := `
+    CREATE TABLE IF NOT EXISTS chat_settings (
+        jid TEXT PRIMARY KEY,
+        model TEXT,
+        temperature REAL,
+        top_p REAL,
+        max_output_tokens INTEGER
+    );`
+	summaryQuery := `
+    CREATE TABLE IF NOT EXISTS conversation_summaries (
+        jid TEXT PRIMARY KEY,
+        summary TEXT NOT NULL,
+        last_message_id INTEGER NOT NULL,
+        updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`
+	personasQuery := `
+    CREATE TABLE IF NOT EXISTS personas (
+        name TEXT PRIMARY KEY,
+        system_prompt TEXT NOT NULL DEFAULT '',
+        model TEXT,
+        temperature REAL,
+        language TEXT
+    );`
+	knowledgeSourcesQuery := `
+    CREATE TABLE IF NOT EXISTS knowledge_sources (
+        path TEXT PRIMARY KEY,
+        hash TEXT NOT NULL,
+        indexed_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`
+	rolesQuery := `
+    CREATE TABLE IF NOT EXISTS roles (
+        jid TEXT PRIMARY KEY,
+        role TEXT NOT NULL,
+        granted_by TEXT,
+        granted_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`
+	accessModesQuery := `
+    CREATE TABLE IF NOT EXISTS access_modes (
+        scope TEXT PRIMARY KEY,
+        mode TEXT NOT NULL
+    );`
+	accessRulesQuery := `
+    CREATE TABLE IF NOT EXISTS access_rules (
+        scope TEXT NOT NULL,
+        jid TEXT NOT NULL,
+        rule TEXT NOT NULL,
+        added_by TEXT,
+        added_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (scope, jid)
+    );`
+	dailyUsageQuery := `
+    CREATE TABLE IF NOT EXISTS daily_usage (
+        jid TEXT NOT NULL,
+        day TEXT NOT NULL,
+        messages INTEGER NOT NULL DEFAULT 0,
+        tokens INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (jid, day)
+    );`
+	tokenUsageQuery := `
+    CREATE TABLE IF NOT EXISTS token_usage (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        day TEXT NOT NULL,
+        chat_jid TEXT NOT NULL,
+        sender_jid TEXT NOT NULL,
+        model TEXT NOT NULL,
+        key_index INTEGER NOT NULL,
+        prompt_tokens INTEGER NOT NULL,
+        candidate_tokens INTEGER NOT NULL,
+        total_tokens INTEGER NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS token_usage_day ON token_usage (day);`
+	responseCacheQuery := `
+    CREATE TABLE IF NOT EXISTS response_cache (
+        key TEXT PRIMARY KEY,
+        response TEXT NOT NULL,
+        model TEXT,
+        hits INTEGER NOT NULL DEFAULT 0,
+        expires_at INTEGER NOT NULL,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`
+	knowledgeChunksQuery := `
+    CREATE TABLE IF NOT EXISTS knowledge_chunks (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        source TEXT NOT NULL REFERENCES knowledge_sources(path) ON DELETE CASCADE,
+        position INTEGER NOT NULL,
+        content TEXT NOT NULL,
+        embedding BLOB NOT NULL
+    );`
 
 	ctx := context.Background()
 	if _, err := db.ExecContext(ctx, userQuery); err != nil {
@@ -55,10 +242,97 @@ func (db *Database) InitSchema() {
 	if _, err := db.ExecContext(ctx, historyQuery); err != nil {
 		log.Fatalf("Failed to create history schema: %v", err)
 	}
+	if _, err := db.ExecContext(ctx, chatSettingsQuery); err != nil {
+		log.Fatalf("Failed to create chat settings schema: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, summaryQuery); err != nil {
+		log.Fatalf("Failed to create summary schema: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, personasQuery); err != nil {
+		log.Fatalf("Failed to create personas schema: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, knowledgeSourcesQuery); err != nil {
+		log.Fatalf("Failed to create knowledge sources schema: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, knowledgeChunksQuery); err != nil {
+		log.Fatalf("Failed to create knowledge chunks schema: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, rolesQuery); err != nil {
+		log.Fatalf("Failed to create roles schema: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, accessModesQuery); err != nil {
+		log.Fatalf("Failed to create access modes schema: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, accessRulesQuery); err != nil {
+		log.Fatalf("Failed to create access rules schema: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, dailyUsageQuery); err != nil {
+		log.Fatalf("Failed to create daily usage schema: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, tokenUsageQuery); err != nil {
+		log.Fatalf("Failed to create token usage schema: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, responseCacheQuery); err != nil {
+		log.Fatalf("Failed to create response cache schema: %v", err)
+	}
+	if err := db.ensureColumn(ctx, "conversation_history", "model", "TEXT"); err != nil {
+		log.Fatalf("Failed to migrate history schema: %v", err)
+	}
+	if err := db.ensureColumn(ctx, "conversation_history", "media_path", "TEXT"); err != nil {
+		log.Fatalf("Failed to migrate history schema: %v", err)
+	}
+	if err := db.ensureColumn(ctx, "conversation_history", "media_mime", "TEXT"); err != nil {
+		log.Fatalf("Failed to migrate history schema: %v", err)
+	}
+	if err := db.ensureColumn(ctx, "knowledge_sources", "embedder", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		log.Fatalf("Failed to migrate knowledge sources schema: %v", err)
+	}
+	if err := db.ensureColumn(ctx, "token_usage", "kind", "TEXT NOT NULL DEFAULT 'chat'"); err != nil {
+		log.Fatalf("Failed to migrate token usage schema: %v", err)
+	}
+	if err := db.ensureColumn(ctx, "chat_settings", "persona", "TEXT"); err != nil {
+		log.Fatalf("Failed to migrate chat settings schema: %v", err)
+	}
+	if err := db.ensureColumn(ctx, "chat_settings", "voice_mode", "TEXT"); err != nil {
+		log.Fatalf("Failed to migrate chat settings schema: %v", err)
+	}
+	if err := db.ensureColumn(ctx, "chat_settings", "trigger_mode", "TEXT"); err != nil {
+		log.Fatalf("Failed to migrate chat settings schema: %v", err)
+	}
 
 	log.Println("Database schema initialized")
 }
 
+// ensureColumn adds column to table when an older database lacks it.
+func (db *Database) ensureColumn(ctx context.Context, table, column, definition string) error {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err == nil {
+		log.Printf("Added column %s to %s", column, table)
+	}
+	return err
+}
+
 func (db *Database) AddMessageToHistory(jid, role, message, userName string) {
 	insertQuery := `INSERT INTO conversation_history (jid, role, message, user_name) VALUES (?, ?, ?, ?)`
 	_, err := db.Exec(insertQuery, jid, role, message, userName)
@@ -68,39 +342,146 @@ func (db *Database) AddMessageToHistory(jid, role, message, userName string) {
 	}
 }
 
-func (db *Database) GetConversationHistory(jid string) []HistoryMessage {
-    query := `
-    SELECT role, message, user_name FROM (
-        SELECT role, message, user_name, timestamp FROM conversation_history
-        WHERE jid = ?
-        ORDER BY timestamp DESC
-        LIMIT 20
-    ) AS recent_messages ORDER BY timestamp ASC;`
-
-    rows, err := db.Query(query, jid)
-    if err != nil {
-        log.Printf("Failed to get conversation history for %s: %v", jid, err)
-        return nil
-    }
-    defer rows.Close()
-
-    var history []HistoryMessage
-    for rows.Next() {
-        var h HistoryMessage
-        var userName sql.NullString
-        if err := rows.Scan(&h.Role, &h.Message, &userName); err != nil {
-            log.Printf("Failed to scan history row for %s: %v", jid, err)
-            continue
-        }
-        h.UserName = userName.String
-        history = append(history, h)
-    }
-    return history
+// AddMediaMessageToHistory stores a user message that came with the file
+// saved at mediaPath, so later requests can send the file again.
+func (db *Database) AddMediaMessageToHistory(jid, message, userName, mediaPath, mediaMIME string) {
+	insertQuery := `INSERT INTO conversation_history (jid, role, message, user_name, media_path, media_mime) VALUES (?, 'user', ?, ?, ?, ?)`
+	_, err := db.Exec(insertQuery, jid, message, userName, mediaPath, mediaMIME)
+	if err != nil {
+		log.Printf("Failed to add media message to history for %s: %v", jid, err)
+	}
+}
+
+// AddModelReplyToHistory stores a reply from Gemini along with the model that
+// generated it.
+func (db *Database) AddModelReplyToHistory(jid, message, model string) {
+	insertQuery := `INSERT INTO conversation_history (jid, role, message, model) VALUES (?, 'model', ?, ?)`
+	_, err := db.Exec(insertQuery, jid, message, model)
+	if err != nil {
+		log.Printf("Failed to add model reply to history for %s: %v", jid, err)
+	}
+}
+
+// GetConversationHistory returns, oldest first, the newest limit messages of
+// jid that have not yet been folded into its running summary.
+func (db *Database) GetConversationHistory(jid string, limit int) []HistoryMessage {
+	query := `
+    SELECT * FROM (
+        SELECT h.id, h.role, h.message, h.user_name, h.media_path, h.media_mime FROM conversation_history h
+        LEFT JOIN conversation_summaries s ON s.jid = h.jid
+        WHERE h.jid = ? AND h.id > COALESCE(s.last_message_id, 0)
+        ORDER BY h.id DESC LIMIT ?
+    ) ORDER BY id ASC;`
+
+	rows, err := db.Query(query, jid, limit)
+	if err != nil {
+		log.Printf("Failed to get conversation history for %s: %v", jid, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var history []HistoryMessage
+	for rows.Next() {
+		var h HistoryMessage
+		var userName, mediaPath, mediaMIME sql.NullString
+		if err := rows.Scan(&h.ID, &h.Role, &h.Message, &userName, &mediaPath, &mediaMIME); err != nil {
+			log.Printf("Failed to scan history row for %s: %v", jid, err)
+			continue
+		}
+		h.UserName = userName.String
+		h.MediaPath = mediaPath.String
+		h.MediaMIME = mediaMIME.String
+		history = append(history, h)
+	}
+	return history
+}
+
+// HasRecentHistory reports whether jid has unsummarized messages newer than
+// window. When userName is set only the messages that user sent count.
+func (db *Database) HasRecentHistory(jid, userName string, window time.Duration) bool {
+	query := `
+    SELECT EXISTS (
+        SELECT 1 FROM conversation_history h
+        LEFT JOIN conversation_summaries s ON s.jid = h.jid
+        WHERE h.jid = ? AND h.id > COALESCE(s.last_message_id, 0) AND h.timestamp >= datetime('now', ?)
+          AND (? = '' OR (h.role = 'user' AND h.user_name = ?))
+    )`
+	var recent bool
+	modifier := fmt.Sprintf("-%d seconds", int(window.Seconds()))
+	if err := db.QueryRow(query, jid, modifier, userName, userName).Scan(&recent); err != nil {
+		log.Printf("Failed to check recent history for %s: %v", jid, err)
+		return true
+	}
+	return recent
+}
+
+// GetConversationSummary returns the running summary of the older messages
+// of jid, or an empty string if nothing has been summarized yet.
+func (db *Database) GetConversationSummary(jid string) string {
+	var summary string
+	err := db.QueryRow(`SELECT summary FROM conversation_summaries WHERE jid = ?`, jid).Scan(&summary)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to get conversation summary for %s: %v", jid, err)
+	}
+	return summary
+}
+
+// SetConversationSummary stores the running summary of jid, which covers
+// every message up to and including lastMessageID.
+func (db *Database) SetConversationSummary(jid, summary string, lastMessageID int64) error {
+	query := `INSERT INTO conversation_summaries (jid, summary, last_message_id) VALUES (?, ?, ?)
+    ON CONFLICT(jid) DO UPDATE SET summary = excluded.summary, last_message_id = excluded.last_message_id, updated_at = CURRENT_TIMESTAMP;`
+	_, err := db.Exec(query, jid, summary, lastMessageID)
+	if err != nil {
+		log.Printf("Failed to set conversation summary for %s: %v", jid, err)
+	}
+	return err
+}
+
+// GetHistoryMediaPaths returns the files stored with the messages of jid.
+func (db *Database) GetHistoryMediaPaths(jid string) ([]string, error) {
+	rows, err := db.Query(`SELECT DISTINCT media_path FROM conversation_history WHERE jid = ? AND media_path IS NOT NULL AND media_path != ''`, jid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// MediaInUse reports whether a message that is still replayed to Gemini,
+// in any chat, refers to the file at path. Messages folded into a summary
+// are no longer replayed. Errors are reported as in use, so that files are
+// not removed by mistake.
+func (db *Database) MediaInUse(path string) bool {
+	query := `
+    SELECT EXISTS (
+        SELECT 1 FROM conversation_history h
+        LEFT JOIN conversation_summaries s ON s.jid = h.jid
+        WHERE h.media_path = ? AND h.id > COALESCE(s.last_message_id, 0)
+    )`
+	var inUse bool
+	if err := db.QueryRow(query, path).Scan(&inUse); err != nil {
+		log.Printf("Failed to check whether %s is in use: %v", path, err)
+		return true
+	}
+	return inUse
 }
 
 func (db *Database) DeleteConversationHistory(jid string) error {
 	query := `DELETE FROM conversation_history WHERE jid = ?`
 	_, err := db.Exec(query, jid)
+	if err == nil {
+		_, err = db.Exec(`DELETE FROM conversation_summaries WHERE jid = ?`, jid)
+	}
 	if err != nil {
 		log.Printf("Failed to delete history for %s: %v", jid, err)
 	} else {
@@ -130,4 +511,547 @@ func (db *Database) SetUserLang(jid, lang string) error {
 		log.Printf("Failed to set user lang for %s: %v", jid, err)
 	}
 	return err
-}
\ No newline at end of file
+}
+
+func (db *Database) GetChatSettings(jid string) ChatSettings {
+	var settings ChatSettings
+	var persona, voiceMode, triggerMode, model sql.NullString
+	var temperature, topP sql.NullFloat64
+	var maxOutputTokens sql.NullInt64
+	query := `SELECT persona, voice_mode, trigger_mode, model, temperature, top_p, max_output_tokens FROM chat_settings WHERE jid = ?`
+	err := db.QueryRow(query, jid).Scan(&persona, &voiceMode, &triggerMode, &model, &temperature, &topP, &maxOutputTokens)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to get chat settings for %s: %v", jid, err)
+		}
+		return settings
+	}
+	settings.Persona = persona.String
+	settings.VoiceMode = voiceMode.String
+	settings.TriggerMode = triggerMode.String
+	settings.Model = model.String
+	if temperature.Valid {
+		settings.Temperature = &temperature.Float64
+	}
+	if topP.Valid {
+		settings.TopP = &topP.Float64
+	}
+	if maxOutputTokens.Valid {
+		settings.MaxOutputTokens = &maxOutputTokens.Int64
+	}
+	return settings
+}
+
+// SetChatModel stores the model override for jid. An empty model clears it.
+func (db *Database) SetChatModel(jid, model string) error {
+	var value sql.NullString
+	if model != "" {
+		value = sql.NullString{String: model, Valid: true}
+	}
+	query := `INSERT INTO chat_settings (jid, model) VALUES (?, ?) ON CONFLICT(jid) DO UPDATE SET model = excluded.model;`
+	_, err := db.Exec(query, jid, value)
+	if err != nil {
+		log.Printf("Failed to set chat model for %s: %v", jid, err)
+	}
+	return err
+}
+
+// SetChatParam stores a generation parameter override for jid. param must be
+// one of "temperature", "top_p" or "max_output_tokens"; a nil value clears it.
+func (db *Database) SetChatParam(jid, param string, value any) error {
+	switch param {
+	case "temperature", "top_p", "max_output_tokens":
+	default:
+		return fmt.Errorf("unknown chat parameter %q", param)
+	}
+	query := fmt.Sprintf(`INSERT INTO chat_settings (jid, %[1]s) VALUES (?, ?) ON CONFLICT(jid) DO UPDATE SET %[1]s = excluded.%[1]s;`, param)
+	_, err := db.Exec(query, jid, value)
+	if err != nil {
+		log.Printf("Failed to set chat parameter %s for %s: %v", param, jid, err)
+	}
+	return err
+}
+
+// SetChatPersona binds the persona named name to jid. An empty name restores
+// the default persona.
+func (db *Database) SetChatPersona(jid, name string) error {
+	var value sql.NullString
+	if name != "" {
+		value = sql.NullString{String: name, Valid: true}
+	}
+	query := `INSERT INTO chat_settings (jid, persona) VALUES (?, ?) ON CONFLICT(jid) DO UPDATE SET persona = excluded.persona;`
+	_, err := db.Exec(query, jid, value)
+	if err != nil {
+		log.Printf("Failed to set persona for %s: %v", jid, err)
+	}
+	return err
+}
+
+// SetChatVoiceMode stores how voice notes in jid are handled. An empty mode
+// restores the default.
+func (db *Database) SetChatVoiceMode(jid, mode string) error {
+	var value sql.NullString
+	if mode != "" {
+		value = sql.NullString{String: mode, Valid: true}
+	}
+	query := `INSERT INTO chat_settings (jid, voice_mode) VALUES (?, ?) ON CONFLICT(jid) DO UPDATE SET voice_mode = excluded.voice_mode;`
+	_, err := db.Exec(query, jid, value)
+	if err != nil {
+		log.Printf("Failed to set voice mode for %s: %v", jid, err)
+	}
+	return err
+}
+
+// SetChatTriggerMode stores which messages the bot answers in the group jid.
+// An empty mode restores the default.
+func (db *Database) SetChatTriggerMode(jid, mode string) error {
+	var value sql.NullString
+	if mode != "" {
+		value = sql.NullString{String: mode, Valid: true}
+	}
+	query := `INSERT INTO chat_settings (jid, trigger_mode) VALUES (?, ?) ON CONFLICT(jid) DO UPDATE SET trigger_mode = excluded.trigger_mode;`
+	_, err := db.Exec(query, jid, value)
+	if err != nil {
+		log.Printf("Failed to set trigger mode for %s: %v", jid, err)
+	}
+	return err
+}
+
+// GetPersona returns the persona named name, or nil if there is none.
+func (db *Database) GetPersona(name string) (*Persona, error) {
+	p := Persona{Name: name}
+	var model, language sql.NullString
+	var temperature sql.NullFloat64
+	query := `SELECT system_prompt, model, temperature, language FROM personas WHERE name = ?`
+	err := db.QueryRow(query, name).Scan(&p.SystemPrompt, &model, &temperature, &language)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Model = model.String
+	p.Language = language.String
+	if temperature.Valid {
+		p.Temperature = &temperature.Float64
+	}
+	return &p, nil
+}
+
+// ListPersonas returns the names of all personas in alphabetical order.
+func (db *Database) ListPersonas() ([]string, error) {
+	rows, err := db.Query(`SELECT name FROM personas ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// SavePersonaPrompt creates the persona named name or replaces its system
+// prompt.
+func (db *Database) SavePersonaPrompt(name, prompt string) error {
+	query := `INSERT INTO personas (name, system_prompt) VALUES (?, ?) ON CONFLICT(name) DO UPDATE SET system_prompt = excluded.system_prompt;`
+	_, err := db.Exec(query, name, prompt)
+	if err != nil {
+		log.Printf("Failed to save persona %s: %v", name, err)
+	}
+	return err
+}
+
+// SetPersonaOption updates one setting of an existing persona. option must
+// be one of "model", "temperature" or "language"; a nil value clears it.
+func (db *Database) SetPersonaOption(name, option string, value any) error {
+	switch option {
+	case "model", "temperature", "language":
+	default:
+		return fmt.Errorf("unknown persona option %q", option)
+	}
+	query := fmt.Sprintf(`UPDATE personas SET %s = ? WHERE name = ?`, option)
+	res, err := db.Exec(query, value, name)
+	if err != nil {
+		log.Printf("Failed to set persona option %s for %s: %v", option, name, err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeletePersona removes a persona and unbinds it from every chat.
+func (db *Database) DeletePersona(name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE chat_settings SET persona = NULL WHERE persona = ?`, name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM personas WHERE name = ?`, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetRole returns the role granted to the user jid, or an empty string if
+// there is none.
+func (db *Database) GetRole(jid string) string {
+	var role string
+	err := db.QueryRow(`SELECT role FROM roles WHERE jid = ?`, jid).Scan(&role)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to get role for %s: %v", jid, err)
+	}
+	return role
+}
+
+// SetRole grants role to the user jid, replacing any role it had.
+func (db *Database) SetRole(jid, role, grantedBy string) error {
+	query := `INSERT INTO roles (jid, role, granted_by) VALUES (?, ?, ?) ON CONFLICT(jid) DO UPDATE SET role = excluded.role, granted_by = excluded.granted_by, granted_at = CURRENT_TIMESTAMP;`
+	_, err := db.Exec(query, jid, role, grantedBy)
+	if err != nil {
+		log.Printf("Failed to set role for %s: %v", jid, err)
+	}
+	return err
+}
+
+// DeleteRole revokes the role of the user jid. It returns sql.ErrNoRows if
+// the user had none.
+func (db *Database) DeleteRole(jid string) error {
+	res, err := db.Exec(`DELETE FROM roles WHERE jid = ?`, jid)
+	if err != nil {
+		log.Printf("Failed to delete role for %s: %v", jid, err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListRoles returns every granted role ordered by user.
+func (db *Database) ListRoles() ([]RoleGrant, error) {
+	rows, err := db.Query(`SELECT jid, role, granted_by FROM roles ORDER BY jid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []RoleGrant
+	for rows.Next() {
+		var g RoleGrant
+		var grantedBy sql.NullString
+		if err := rows.Scan(&g.JID, &g.Role, &grantedBy); err != nil {
+			return nil, err
+		}
+		g.GrantedBy = grantedBy.String
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// GetAccessMode returns the access mode of scope, which is a group JID, the
+// JID of a private chat, or empty for the default of private chats. It
+// returns an empty string if none was set.
+func (db *Database) GetAccessMode(scope string) string {
+	var mode string
+	err := db.QueryRow(`SELECT mode FROM access_modes WHERE scope = ?`, scope).Scan(&mode)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to get access mode for %q: %v", scope, err)
+	}
+	return mode
+}
+
+// SetAccessMode stores the access mode of scope. An empty mode restores the
+// default.
+func (db *Database) SetAccessMode(scope, mode string) error {
+	var err error
+	if mode == "" {
+		_, err = db.Exec(`DELETE FROM access_modes WHERE scope = ?`, scope)
+	} else {
+		query := `INSERT INTO access_modes (scope, mode) VALUES (?, ?) ON CONFLICT(scope) DO UPDATE SET mode = excluded.mode;`
+		_, err = db.Exec(query, scope, mode)
+	}
+	if err != nil {
+		log.Printf("Failed to set access mode for %q: %v", scope, err)
+	}
+	return err
+}
+
+// GetAccessRule returns the rule for the user jid in scope, or an empty
+// string if there is none.
+func (db *Database) GetAccessRule(scope, jid string) string {
+	var rule string
+	err := db.QueryRow(`SELECT rule FROM access_rules WHERE scope = ? AND jid = ?`, scope, jid).Scan(&rule)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to get access rule for %s in %q: %v", jid, scope, err)
+	}
+	return rule
+}
+
+// SetAccessRule allows or blocks the user jid in scope, replacing any rule
+// it had there.
+func (db *Database) SetAccessRule(scope, jid, rule, addedBy string) error {
+	query := `INSERT INTO access_rules (scope, jid, rule, added_by) VALUES (?, ?, ?, ?) ON CONFLICT(scope, jid) DO UPDATE SET rule = excluded.rule, added_by = excluded.added_by, added_at = CURRENT_TIMESTAMP;`
+	_, err := db.Exec(query, scope, jid, rule, addedBy)
+	if err != nil {
+		log.Printf("Failed to set access rule for %s in %q: %v", jid, scope, err)
+	}
+	return err
+}
+
+// DeleteAccessRule removes the rule for the user jid in scope. It returns
+// sql.ErrNoRows if there was none.
+func (db *Database) DeleteAccessRule(scope, jid string) error {
+	res, err := db.Exec(`DELETE FROM access_rules WHERE scope = ? AND jid = ?`, scope, jid)
+	if err != nil {
+		log.Printf("Failed to delete access rule for %s in %q: %v", jid, scope, err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListAccessRules returns the rules of scope ordered by rule and user.
+func (db *Database) ListAccessRules(scope string) ([]AccessRule, error) {
+	rows, err := db.Query(`SELECT jid, rule, added_by FROM access_rules WHERE scope = ? ORDER BY rule, jid`, scope)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []AccessRule
+	for rows.Next() {
+		var r AccessRule
+		var addedBy sql.NullString
+		if err := rows.Scan(&r.JID, &r.Rule, &addedBy); err != nil {
+			return nil, err
+		}
+		r.AddedBy = addedBy.String
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// GetDailyUsage returns how many messages and tokens the user jid used on
+// day, formatted as YYYY-MM-DD.
+func (db *Database) GetDailyUsage(jid, day string) (messages, tokens int64) {
+	query := `SELECT messages, tokens FROM daily_usage WHERE jid = ? AND day = ?`
+	err := db.QueryRow(query, jid, day).Scan(&messages, &tokens)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to get daily usage for %s: %v", jid, err)
+	}
+	return messages, tokens
+}
+
+// AddDailyUsage adds messages and tokens to what the user jid used on day.
+func (db *Database) AddDailyUsage(jid, day string, messages, tokens int64) error {
+	query := `INSERT INTO daily_usage (jid, day, messages, tokens) VALUES (?, ?, ?, ?) ON CONFLICT(jid, day) DO UPDATE SET messages = messages + excluded.messages, tokens = tokens + excluded.tokens;`
+	_, err := db.Exec(query, jid, day, messages, tokens)
+	if err != nil {
+		log.Printf("Failed to add daily usage for %s: %v", jid, err)
+	}
+	return err
+}
+
+// AddTokenUsage records one request to Gemini.
+func (db *Database) AddTokenUsage(u TokenUsage) error {
+	query := `INSERT INTO token_usage (day, kind, chat_jid, sender_jid, model, key_index, prompt_tokens, candidate_tokens, total_tokens) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, u.Day, u.Kind, u.ChatJID, u.SenderJID, u.Model, u.KeyIndex, u.PromptTokens, u.CandidateTokens, u.TotalTokens)
+	if err != nil {
+		log.Printf("Failed to record token usage for %s: %v", u.ChatJID, err)
+	}
+	return err
+}
+
+// GetUsageTotals sums the recorded requests from day from to day to
+// inclusive, per day, kind, chat, sender and model.
+func (db *Database) GetUsageTotals(from, to string) ([]UsageTotal, error) {
+	query := `
+    SELECT day, kind, chat_jid, sender_jid, model, COUNT(*), SUM(prompt_tokens), SUM(candidate_tokens), SUM(total_tokens)
+    FROM token_usage
+    WHERE day >= ? AND day <= ?
+    GROUP BY day, kind, chat_jid, sender_jid, model
+    ORDER BY day, kind, chat_jid, sender_jid, model`
+	rows, err := db.Query(query, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var totals []UsageTotal
+	for rows.Next() {
+		var t UsageTotal
+		if err := rows.Scan(&t.Day, &t.Kind, &t.ChatJID, &t.SenderJID, &t.Model, &t.Requests, &t.PromptTokens, &t.CandidateTokens, &t.TotalTokens); err != nil {
+			return nil, err
+		}
+		totals = append(totals, t)
+	}
+	return totals, rows.Err()
+}
+
+// GetCachedResponse returns the unexpired response cached under key with
+// the model that wrote it, and counts the hit.
+func (db *Database) GetCachedResponse(key string) (response, model string, ok bool) {
+	var m sql.NullString
+	query := `UPDATE response_cache SET hits = hits + 1 WHERE key = ? AND expires_at > ? RETURNING response, model`
+	err := db.QueryRow(query, key, time.Now().Unix()).Scan(&response, &m)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to read cached response: %v", err)
+		}
+		return "", "", false
+	}
+	return response, m.String, true
+}
+
+// SetCachedResponse caches response under key for ttl and drops expired
+// entries.
+func (db *Database) SetCachedResponse(key, response, model string, ttl time.Duration) error {
+	now := time.Now()
+	if _, err := db.Exec(`DELETE FROM response_cache WHERE expires_at <= ?`, now.Unix()); err != nil {
+		log.Printf("Failed to drop expired responses: %v", err)
+	}
+	query := `INSERT INTO response_cache (key, response, model, expires_at) VALUES (?, ?, ?, ?) ON CONFLICT(key) DO UPDATE SET response = excluded.response, model = excluded.model, hits = 0, expires_at = excluded.expires_at, created_at = CURRENT_TIMESTAMP;`
+	_, err := db.Exec(query, key, response, model, now.Add(ttl).Unix())
+	if err != nil {
+		log.Printf("Failed to cache response: %v", err)
+	}
+	return err
+}
+
+// FlushResponseCache removes every cached response and returns how many
+// there were.
+func (db *Database) FlushResponseCache() (int64, error) {
+	res, err := db.Exec(`DELETE FROM response_cache`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ResponseCacheStats returns the number of unexpired cached responses and
+// how often they were served.
+func (db *Database) ResponseCacheStats() (entries, hits int64, err error) {
+	query := `SELECT COUNT(*), COALESCE(SUM(hits), 0) FROM response_cache WHERE expires_at > ?`
+	err = db.QueryRow(query, time.Now().Unix()).Scan(&entries, &hits)
+	return entries, hits, err
+}
+
+// GetKnowledgeSources returns every indexed document keyed by its path.
+func (db *Database) GetKnowledgeSources() (map[string]KnowledgeSource, error) {
+	rows, err := db.Query(`SELECT path, hash, embedder FROM knowledge_sources`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sources := make(map[string]KnowledgeSource)
+	for rows.Next() {
+		var path string
+		var s KnowledgeSource
+		if err := rows.Scan(&path, &s.Hash, &s.Embedder); err != nil {
+			return nil, err
+		}
+		sources[path] = s
+	}
+	return sources, rows.Err()
+}
+
+// ReplaceKnowledgeSource stores the chunks of the document at path, replacing any chunks indexed for an earlier version of it.
+func (db *Database) ReplaceKnowledgeSource(path string, source KnowledgeSource, chunks []KnowledgeChunk) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM knowledge_chunks WHERE source = ?`, path); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO knowledge_sources (path, hash, embedder) VALUES (?, ?, ?) ON CONFLICT(path) DO UPDATE SET hash = excluded.hash, embedder = excluded.embedder, indexed_at = CURRENT_TIMESTAMP;`,
+		path, source.Hash, source.Embedder); err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		if _, err := tx.Exec(`INSERT INTO knowledge_chunks (source, position, content, embedding) VALUES (?, ?, ?, ?)`,
+			path, c.Position, c.Content, encodeVector(c.Embedding)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteKnowledgeSource removes a document and its chunks from the index.
+func (db *Database) DeleteKnowledgeSource(path string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM knowledge_chunks WHERE source = ?`, path); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM knowledge_sources WHERE path = ?`, path); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetKnowledgeChunks returns every chunk embedded by embedder with its
+// embedding.
+func (db *Database) GetKnowledgeChunks(embedder string) ([]KnowledgeChunk, error) {
+	query := `
+    SELECT c.source, c.position, c.content, c.embedding
+    FROM knowledge_chunks c JOIN knowledge_sources s ON s.path = c.source
+    WHERE s.embedder = ?
+    ORDER BY c.source, c.position`
+	rows, err := db.Query(query, embedder)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunks []KnowledgeChunk
+	for rows.Next() {
+		var c KnowledgeChunk
+		var blob []byte
+		if err := rows.Scan(&c.Source, &c.Position, &c.Content, &blob); err != nil {
+			return nil, err
+		}
+		c.Embedding = decodeVector(blob)
+		chunks = append(chunks, c)
+	}
+	return chunks, rows.Err()
+}
+
+// encodeVector packs v as little-endian float32 values.
+func encodeVector(v []float32) []byte {
+	buf := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(f))
+	}
+	return buf
+}
+
+func decodeVector(buf []byte) []float32 {
+	v := make([]float32, len(buf)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return v
+}
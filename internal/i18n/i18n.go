@@ -2,6 +2,7 @@ package i18n
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 
 	"github.com/nicksnyder/go-i18n/v2/i18n"
@@ -9,20 +10,30 @@ import (
 )
 
 func NewBundle() *i18n.Bundle {
+	bundle, err := LoadBundle()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return bundle
+}
+
+// LoadBundle reads the translation files into a new bundle, returning an
+// error instead of exiting when one of them is invalid.
+func LoadBundle() (*i18n.Bundle, error) {
 	bundle := i18n.NewBundle(language.English)
 	bundle.RegisterUnmarshalFunc("json", json.Unmarshal)
 
 	_, err := bundle.LoadMessageFile("locales/en.json")
 	if err != nil {
-		log.Fatalf("Failed to load English translation file: %v", err)
+		return nil, fmt.Errorf("failed to load English translation file: %w", err)
 	}
 	_, err = bundle.LoadMessageFile("locales/id.json")
 	if err != nil {
-		log.Fatalf("Failed to load Indonesian translation file: %v", err)
+		return nil, fmt.Errorf("failed to load Indonesian translation file: %w", err)
 	}
 
 	log.Println("i18n bundle loaded successfully")
-	return bundle
+	return bundle, nil
 }
 
 func NewLocalizer(bundle *i18n.Bundle, lang string) *i18n.Localizer {
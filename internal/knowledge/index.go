@@ -0,0 +1,241 @@
+package knowledge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gemini-whatsapp-bot/internal/db"
+)
+
+const (
+	// chunkWords is the number of words in one indexed passage.
+	chunkWords = 200
+	// chunkOverlap is the number of words repeated at the start of the next
+	// passage, so a sentence cut at a boundary is still found whole.
+	chunkOverlap = 40
+)
+
+// Embedder turns texts into vectors. The index embeds documents and queries
+// with the same Embedder, since vectors from different models cannot be
+// compared.
+type Embedder interface {
+	Embed(texts []string) ([][]float32, error)
+}
+
+// EmbedderFunc adapts a function to the Embedder interface.
+type EmbedderFunc func(texts []string) ([][]float32, error)
+
+func (f EmbedderFunc) Embed(texts []string) ([][]float32, error) {
+	return f(texts)
+}
+
+// TextExtractor returns the plain text of a binary document such as a PDF.
+type TextExtractor func(data []byte) (string, error)
+
+// Match is an indexed passage returned by Search.
+type Match struct {
+	Source  string
+	Content string
+	Score   float64
+}
+
+// Index is a vector index over a directory of Markdown, text and PDF files.
+// Chunks and their embeddings are stored in SQLite, so only documents that
+// changed since the last build, or were embedded by another model, are
+// embedded again.
+type Index struct {
+	db       *db.Database
+	embedder Embedder
+	model    string
+	pdfText  TextExtractor
+
+	mu     sync.RWMutex
+	chunks []db.KnowledgeChunk
+}
+
+// NewIndex returns an index stored in database. model names the embedding
+// model behind embedder and is stored with the vectors. pdfText may be nil,
+// in which case PDF files are skipped.
+func NewIndex(database *db.Database, embedder Embedder, model string, pdfText TextExtractor) *Index {
+	return &Index{db: database, embedder: embedder, model: model, pdfText: pdfText}
+}
+
+// Build indexes every supported file under dir, re-embedding only the files
+// whose content or embedding model changed and dropping files that no longer
+// exist.
+func (ix *Index) Build(dir string) error {
+	stored, err := ix.db.GetKnowledgeSources()
+	if err != nil {
+		return fmt.Errorf("reading indexed sources: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isIndexable(path) {
+			return nil
+		}
+		seen[path] = true
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Could not read knowledge document %s: %v", path, err)
+			return nil
+		}
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		if stored[path] == (db.KnowledgeSource{Hash: hash, Embedder: ix.model}) {
+			return nil
+		}
+
+		if err := ix.indexFile(path, hash, data); err != nil {
+			log.Printf("Could not index knowledge document %s: %v", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for path := range stored {
+		if !seen[path] {
+			if err := ix.db.DeleteKnowledgeSource(path); err != nil {
+				log.Printf("Could not remove %s from the knowledge index: %v", path, err)
+			}
+		}
+	}
+
+	return ix.load()
+}
+
+func (ix *Index) indexFile(path, hash string, data []byte) error {
+	text := string(data)
+	if strings.EqualFold(filepath.Ext(path), ".pdf") {
+		if ix.pdfText == nil {
+			return fmt.Errorf("no PDF text extractor configured")
+		}
+		var err error
+		if text, err = ix.pdfText(data); err != nil {
+			return err
+		}
+	}
+
+	passages := chunkText(text)
+	var chunks []db.KnowledgeChunk
+	if len(passages) > 0 {
+		vectors, err := ix.embedder.Embed(passages)
+		if err != nil {
+			return err
+		}
+		for i, passage := range passages {
+			chunks = append(chunks, db.KnowledgeChunk{
+				Source:    path,
+				Position:  i,
+				Content:   passage,
+				Embedding: vectors[i],
+			})
+		}
+	}
+
+	if err := ix.db.ReplaceKnowledgeSource(path, db.KnowledgeSource{Hash: hash, Embedder: ix.model}, chunks); err != nil {
+		return err
+	}
+	log.Printf("Indexed %s (%d chunks)", path, len(chunks))
+	return nil
+}
+
+// load reads the chunks embedded by the current model into memory for
+// searching. Documents that could not be embedded again after a model change
+// are left out until they are.
+func (ix *Index) load() error {
+	chunks, err := ix.db.GetKnowledgeChunks(ix.model)
+	if err != nil {
+		return fmt.Errorf("reading knowledge chunks: %w", err)
+	}
+	ix.mu.Lock()
+	ix.chunks = chunks
+	ix.mu.Unlock()
+	log.Printf("Knowledge index ready with %d chunks", len(chunks))
+	return nil
+}
+
+// Search returns the k passages most similar to query, best first.
+func (ix *Index) Search(query string, k int) ([]Match, error) {
+	ix.mu.RLock()
+	chunks := ix.chunks
+	ix.mu.RUnlock()
+	if len(chunks) == 0 || k <= 0 || strings.TrimSpace(query) == "" {
+		return nil, nil
+	}
+
+	vectors, err := ix.embedder.Embed([]string{query})
+	if err != nil {
+		return nil, err
+	}
+	q := vectors[0]
+
+	matches := make([]Match, 0, len(chunks))
+	for _, c := range chunks {
+		score := cosine(q, c.Embedding)
+		if score <= 0 {
+			continue
+		}
+		matches = append(matches, Match{Source: c.Source, Content: c.Content, Score: score})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+	if len(matches) > k {
+		matches = matches[:k]
+	}
+	return matches, nil
+}
+
+func isIndexable(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".md", ".markdown", ".txt", ".pdf":
+		return true
+	}
+	return false
+}
+
+// chunkText splits text into overlapping passages of chunkWords words.
+func chunkText(text string) []string {
+	words := strings.Fields(text)
+	var passages []string
+	for start := 0; start < len(words); start += chunkWords - chunkOverlap {
+		end := min(start+chunkWords, len(words))
+		passages = append(passages, strings.Join(words[start:end], " "))
+		if end == len(words) {
+			break
+		}
+	}
+	return passages
+}
+
+func cosine(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
@@ -0,0 +1,213 @@
+package knowledge
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gemini-whatsapp-bot/internal/db"
+)
+
+// fakeEmbedder hashes words into dims buckets, so texts that share words get
+// similar vectors, and records every text it embeds.
+type fakeEmbedder struct {
+	dims     int
+	embedded []string
+}
+
+func (e *fakeEmbedder) Embed(texts []string) ([][]float32, error) {
+	e.embedded = append(e.embedded, texts...)
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		v := make([]float32, e.dims)
+		for _, word := range strings.Fields(strings.ToLower(text)) {
+			h := fnv.New32a()
+			h.Write([]byte(strings.Trim(word, ".,?!")))
+			v[h.Sum32()%uint32(len(v))]++
+		}
+		vectors[i] = v
+	}
+	return vectors, nil
+}
+
+func newTestDatabase(t *testing.T) (*db.Database, string) {
+	t.Helper()
+	dir := t.TempDir()
+	database := db.New(filepath.Join(dir, "bot.db"))
+	t.Cleanup(func() { database.Close() })
+	database.InitSchema()
+
+	docs := filepath.Join(dir, "docs")
+	if err := os.Mkdir(docs, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return database, docs
+}
+
+func newTestIndex(t *testing.T) (*Index, *fakeEmbedder, string) {
+	t.Helper()
+	database, docs := newTestDatabase(t)
+	embedder := &fakeEmbedder{dims: 64}
+	return NewIndex(database, embedder, "fake-64", nil), embedder, docs
+}
+
+func writeDoc(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func words(n int) string {
+	w := make([]string, n)
+	for i := range w {
+		w[i] = fmt.Sprintf("w%d", i)
+	}
+	return strings.Join(w, " ")
+}
+
+func TestChunkText(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		starts []string
+	}{
+		{name: "empty", text: "  \n "},
+		{name: "short", text: "opening hours are 9 to 5", starts: []string{"opening"}},
+		{name: "one chunk", text: words(chunkWords), starts: []string{"w0"}},
+		{name: "overlapping", text: words(450), starts: []string{"w0", "w160", "w320"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			passages := chunkText(tt.text)
+			if len(passages) != len(tt.starts) {
+				t.Fatalf("got %d passages, want %d", len(passages), len(tt.starts))
+			}
+			for i, p := range passages {
+				fields := strings.Fields(p)
+				if fields[0] != tt.starts[i] {
+					t.Errorf("passage %d starts with %q, want %q", i, fields[0], tt.starts[i])
+				}
+				if len(fields) > chunkWords {
+					t.Errorf("passage %d has %d words, want at most %d", i, len(fields), chunkWords)
+				}
+			}
+		})
+	}
+
+	passages := chunkText(words(450))
+	if last := strings.Fields(passages[len(passages)-1]); last[len(last)-1] != "w449" {
+		t.Errorf("last passage ends with %q, want w449", last[len(last)-1])
+	}
+}
+
+func TestBuildReembedsChangedFilesOnly(t *testing.T) {
+	ix, embedder, docs := newTestIndex(t)
+	writeDoc(t, docs, "hours.md", "The shop is open from nine to five.")
+	writeDoc(t, docs, "shipping.txt", "Orders ship within two days.")
+	writeDoc(t, docs, "notes.go", "package notes")
+
+	if err := ix.Build(docs); err != nil {
+		t.Fatal(err)
+	}
+	if len(embedder.embedded) != 2 {
+		t.Fatalf("first build embedded %q, want the two documents", embedder.embedded)
+	}
+
+	embedder.embedded = nil
+	if err := ix.Build(docs); err != nil {
+		t.Fatal(err)
+	}
+	if len(embedder.embedded) != 0 {
+		t.Fatalf("rebuild embedded unchanged documents %q", embedder.embedded)
+	}
+
+	writeDoc(t, docs, "hours.md", "The shop is open from ten to six.")
+	if err := ix.Build(docs); err != nil {
+		t.Fatal(err)
+	}
+	if len(embedder.embedded) != 1 || !strings.Contains(embedder.embedded[0], "ten to six") {
+		t.Fatalf("rebuild embedded %q, want only the changed document", embedder.embedded)
+	}
+
+	if err := os.Remove(filepath.Join(docs, "shipping.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Build(docs); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := ix.Search("orders ship days", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range matches {
+		if strings.HasSuffix(m.Source, "shipping.txt") {
+			t.Errorf("deleted document %s is still indexed", m.Source)
+		}
+	}
+}
+
+func TestSearchRanksBySimilarity(t *testing.T) {
+	ix, _, docs := newTestIndex(t)
+	writeDoc(t, docs, "hours.md", "Opening hours: we are open every day from nine to five.")
+	writeDoc(t, docs, "shipping.md", "Shipping: orders are shipped by courier within two days.")
+	writeDoc(t, docs, "payment.md", "Payment: we accept bank transfer and cash on delivery.")
+	if err := ix.Build(docs); err != nil {
+		t.Fatal(err)
+	}
+
+	matches, err := ix.Search("what are your opening hours every day", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 || len(matches) > 2 {
+		t.Fatalf("got %d matches, want 1 or 2", len(matches))
+	}
+	if !strings.HasSuffix(matches[0].Source, "hours.md") {
+		t.Errorf("best match is %s, want hours.md", matches[0].Source)
+	}
+	for i := 1; i < len(matches); i++ {
+		if matches[i].Score > matches[i-1].Score {
+			t.Errorf("matches are not sorted by score: %v", matches)
+		}
+	}
+
+	if matches, _ := ix.Search("   ", 2); matches != nil {
+		t.Errorf("blank query returned %v", matches)
+	}
+}
+
+func TestBuildReembedsAfterModelChange(t *testing.T) {
+	database, docs := newTestDatabase(t)
+	writeDoc(t, docs, "hours.md", "The shop is open from nine to five.")
+	writeDoc(t, docs, "shipping.md", "Orders ship within two days.")
+
+	if err := NewIndex(database, &fakeEmbedder{dims: 64}, "fake-64", nil).Build(docs); err != nil {
+		t.Fatal(err)
+	}
+
+	embedder := &fakeEmbedder{dims: 32}
+	ix := NewIndex(database, embedder, "fake-32", nil)
+	if err := ix.Build(docs); err != nil {
+		t.Fatal(err)
+	}
+	if len(embedder.embedded) != 2 {
+		t.Fatalf("build with a new model embedded %q, want every document", embedder.embedded)
+	}
+
+	matches, err := ix.Search("when is the shop open", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || !strings.HasSuffix(matches[0].Source, "hours.md") {
+		t.Fatalf("got %v, want hours.md", matches)
+	}
+	for _, c := range ix.chunks {
+		if len(c.Embedding) != 32 {
+			t.Errorf("chunk of %s has %d dimensions, want 32", c.Source, len(c.Embedding))
+		}
+	}
+}
@@ -1,39 +1,354 @@
 package knowledge
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+type FAQ struct {
+	Question string `yaml:"question"`
+	Answer   string `yaml:"answer"`
+}
+
+type Product struct {
+	Name        string `yaml:"name"`
+	Price       string `yaml:"price"`
+	Description string `yaml:"description"`
+}
+
+type OpeningHours struct {
+	Days  string `yaml:"days"`
+	Hours string `yaml:"hours"`
+}
+
+type Contact struct {
+	Phone   string `yaml:"phone"`
+	Email   string `yaml:"email"`
+	Address string `yaml:"address"`
+	Website string `yaml:"website"`
+}
+
+// Knowledge is the bot's persona and shop information. Every text field may
+// use text/template syntax with TemplateData, e.g. {{.UserName}}.
 type Knowledge struct {
-	Content string
+	Persona      string         `yaml:"persona"`
+	Rules        []string       `yaml:"rules"`
+	FAQ          []FAQ          `yaml:"faq"`
+	Products     []Product      `yaml:"products"`
+	OpeningHours []OpeningHours `yaml:"opening_hours"`
+	Contact      Contact        `yaml:"contact"`
+	Timezone     string         `yaml:"timezone"`
+	// Content is the free-form text of the original single-key format.
+	Content string `yaml:"knowledge"`
+
+	location *time.Location
+	tmpl     *template.Template
+	// fields are the TemplateData fields the templates read.
+	fields map[string]bool
 }
 
-type yamlData struct {
-	Knowledge string `yaml:"knowledge"`
+// TemplateData is available to the templates in the knowledge file.
+type TemplateData struct {
+	UserName  string
+	ChatType  string
+	GroupName string
+	Language  string
+	Now       time.Time
+	Date      string
+	Time      string
+	Weekday   string
 }
 
 func Load(filePath string) *Knowledge {
 	if filePath == "" {
 		log.Println("Knowledge file path is not provided, skipping.")
-		return &Knowledge{Content: ""}
+		return &Knowledge{}
 	}
 
 	data, err := os.ReadFile(filePath)
 	if err != nil {
 		log.Printf("Could not read knowledge file at %s: %v", filePath, err)
-		return &Knowledge{Content: ""}
+		return &Knowledge{}
 	}
 
-	var parsed yamlData
-	err = yaml.Unmarshal(data, &parsed)
+	k, err := Parse(data)
 	if err != nil {
 		log.Printf("Could not parse knowledge YAML file: %v", err)
-		return &Knowledge{Content: ""}
+		return &Knowledge{}
 	}
 
 	log.Println("Knowledge base loaded successfully.")
-	return &Knowledge{Content: parsed.Knowledge}
-}
\ No newline at end of file
+	return k
+}
+
+// LoadFile is like Load but returns an error when the file cannot be read or
+// parsed, so a reload can keep the knowledge it already has.
+func LoadFile(filePath string) (*Knowledge, error) {
+	if filePath == "" {
+		return &Knowledge{}, nil
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse reads a knowledge file and compiles its templates.
+func Parse(data []byte) (*Knowledge, error) {
+	var k Knowledge
+	if err := yaml.Unmarshal(data, &k); err != nil {
+		return nil, err
+	}
+	if err := k.compile(); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// WithPersona returns knowledge made of prompt alone, in the timezone of k.
+// It is used for chats bound to a persona with its own system prompt.
+func (k *Knowledge) WithPersona(prompt string) (*Knowledge, error) {
+	p := &Knowledge{Persona: prompt}
+	if k != nil {
+		p.Timezone = k.Timezone
+	}
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// compile resolves the timezone and parses the templates.
+func (k *Knowledge) compile() error {
+	k.location = time.Local
+	if k.Timezone != "" {
+		loc, err := time.LoadLocation(k.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone %q: %w", k.Timezone, err)
+		}
+		k.location = loc
+	}
+
+	tmpl, err := template.New("knowledge").Option("missingkey=zero").Parse(k.source())
+	if err != nil {
+		return fmt.Errorf("invalid template: %w", err)
+	}
+	k.tmpl = tmpl
+	k.fields = make(map[string]bool)
+	if tmpl.Tree != nil {
+		readFields(tmpl.Tree.Root, k.fields)
+	}
+	return nil
+}
+
+// readFields adds the names of the fields of dot that node reads to fields.
+// A bare {{.}} reads all of them and is recorded as ".".
+func readFields(node parse.Node, fields map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			readFields(child, fields)
+		}
+	case *parse.ActionNode:
+		readFields(n.Pipe, fields)
+	case *parse.IfNode:
+		readBranchFields(&n.BranchNode, fields)
+	case *parse.RangeNode:
+		readBranchFields(&n.BranchNode, fields)
+	case *parse.WithNode:
+		readBranchFields(&n.BranchNode, fields)
+	case *parse.TemplateNode:
+		readFields(n.Pipe, fields)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			readFields(cmd, fields)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			readFields(arg, fields)
+		}
+	case *parse.ChainNode:
+		readFields(n.Node, fields)
+	case *parse.FieldNode:
+		fields[n.Ident[0]] = true
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			fields[n.Ident[1]] = true
+		} else if len(n.Ident) == 1 && n.Ident[0] == "$" {
+			fields["."] = true
+		}
+	case *parse.DotNode:
+		fields["."] = true
+	}
+}
+
+func readBranchFields(n *parse.BranchNode, fields map[string]bool) {
+	readFields(n.Pipe, fields)
+	readFields(n.List, fields)
+	readFields(n.ElseList, fields)
+}
+
+// perRequestFields are the TemplateData fields that differ between senders
+// or from one minute to the next.
+var perRequestFields = []string{".", "UserName", "Now", "Time"}
+
+// Version identifies the instruction SystemInstruction would render from
+// data without rendering it: the templates, the timezone and the values of
+// the fields they read. It reports false when the templates read a field in
+// perRequestFields, since then no two requests can share the instruction.
+func (k *Knowledge) Version(data TemplateData) (string, bool) {
+	if k.Empty() {
+		return "", true
+	}
+	for _, field := range perRequestFields {
+		if k.fields[field] {
+			return "", false
+		}
+	}
+
+	shared := map[string]string{
+		"ChatType":  data.ChatType,
+		"GroupName": data.GroupName,
+		"Language":  data.Language,
+		"Date":      data.Date,
+		"Weekday":   data.Weekday,
+	}
+	var names []string
+	for name := range k.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := []string{k.Timezone, k.source()}
+	for _, name := range names {
+		parts = append(parts, name+"="+shared[name])
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:]), true
+}
+
+// Empty reports whether the knowledge base has nothing to render.
+func (k *Knowledge) Empty() bool {
+	return k == nil || k.tmpl == nil || strings.TrimSpace(k.source()) == ""
+}
+
+// NewTemplateData fills the date and time fields in the store timezone.
+func (k *Knowledge) NewTemplateData(userName, chatType, groupName, language string) TemplateData {
+	loc := time.Local
+	if k != nil && k.location != nil {
+		loc = k.location
+	}
+	now := time.Now().In(loc)
+	return TemplateData{
+		UserName:  userName,
+		ChatType:  chatType,
+		GroupName: groupName,
+		Language:  language,
+		Now:       now,
+		Date:      now.Format("2006-01-02"),
+		Time:      now.Format("15:04"),
+		Weekday:   now.Weekday().String(),
+	}
+}
+
+// SystemInstruction renders the knowledge with data, ready to be sent as the
+// model's system instruction.
+func (k *Knowledge) SystemInstruction(data TemplateData) (string, error) {
+	if k.Empty() {
+		return "", nil
+	}
+	var sb strings.Builder
+	if err := k.tmpl.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
+
+// source assembles the sections into one template text.
+func (k *Knowledge) source() string {
+	var sections []string
+
+	if k.Persona != "" {
+		sections = append(sections, strings.TrimSpace(k.Persona))
+	}
+	if k.Content != "" {
+		sections = append(sections, strings.TrimSpace(k.Content))
+	}
+	if len(k.Rules) > 0 {
+		var sb strings.Builder
+		sb.WriteString("RULES:")
+		for _, rule := range k.Rules {
+			sb.WriteString("\n- " + strings.TrimSpace(rule))
+		}
+		sections = append(sections, sb.String())
+	}
+	if len(k.FAQ) > 0 {
+		var sb strings.Builder
+		sb.WriteString("FREQUENTLY ASKED QUESTIONS:")
+		for _, faq := range k.FAQ {
+			fmt.Fprintf(&sb, "\nQ: %s\nA: %s", faq.Question, faq.Answer)
+		}
+		sections = append(sections, sb.String())
+	}
+	if len(k.Products) > 0 {
+		var sb strings.Builder
+		sb.WriteString("PRODUCTS:")
+		for _, p := range k.Products {
+			sb.WriteString("\n- " + p.Name)
+			if p.Price != "" {
+				sb.WriteString(" (" + p.Price + ")")
+			}
+			if p.Description != "" {
+				sb.WriteString(": " + p.Description)
+			}
+		}
+		sections = append(sections, sb.String())
+	}
+	if len(k.OpeningHours) > 0 {
+		var sb strings.Builder
+		sb.WriteString("OPENING HOURS:")
+		for _, oh := range k.OpeningHours {
+			fmt.Fprintf(&sb, "\n- %s: %s", oh.Days, oh.Hours)
+		}
+		sections = append(sections, sb.String())
+	}
+	if contact := k.Contact.String(); contact != "" {
+		sections = append(sections, "CONTACT:\n"+contact)
+	}
+
+	return strings.Join(sections, "\n\n")
+}
+
+func (c Contact) String() string {
+	var lines []string
+	if c.Phone != "" {
+		lines = append(lines, "Phone: "+c.Phone)
+	}
+	if c.Email != "" {
+		lines = append(lines, "Email: "+c.Email)
+	}
+	if c.Address != "" {
+		lines = append(lines, "Address: "+c.Address)
+	}
+	if c.Website != "" {
+		lines = append(lines, "Website: "+c.Website)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,65 @@
+package knowledge
+
+import "testing"
+
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		persona   string
+		cacheable bool
+	}{
+		{name: "static", persona: "You are a helpful shop assistant.", cacheable: true},
+		{name: "chat type", persona: `{{if eq .ChatType "group"}}Keep it short.{{end}}`, cacheable: true},
+		{name: "date", persona: "Today is {{.Weekday}} {{.Date}}.", cacheable: true},
+		{name: "user name", persona: "You are talking to {{.UserName}}.", cacheable: false},
+		{name: "time", persona: "It is {{.Time}}.", cacheable: false},
+		{name: "nested user name", persona: "{{if .ChatType}}{{with .Language}}Hi {{$.UserName}}{{end}}{{end}}", cacheable: false},
+		{name: "now", persona: "{{.Now.Hour}}", cacheable: false},
+		{name: "whole data", persona: "{{printf \"%v\" .}}", cacheable: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := (&Knowledge{}).WithPersona(tt.persona)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ann := k.NewTemplateData("Ann", "private", "", "en")
+			bob := k.NewTemplateData("Bob", "private", "", "en")
+
+			annVersion, ok := k.Version(ann)
+			if ok != tt.cacheable {
+				t.Fatalf("Version reported %v, want %v", ok, tt.cacheable)
+			}
+			if !ok {
+				return
+			}
+			if bobVersion, _ := k.Version(bob); bobVersion != annVersion {
+				t.Errorf("versions differ between senders: %q and %q", annVersion, bobVersion)
+			}
+		})
+	}
+}
+
+func TestVersionFollowsReadFields(t *testing.T) {
+	k, err := (&Knowledge{}).WithPersona(`{{if eq .ChatType "group"}}Keep it short.{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, _ := k.Version(k.NewTemplateData("Ann", "private", "", "en"))
+	group, _ := k.Version(k.NewTemplateData("Ann", "group", "Friends", "en"))
+	if private == group {
+		t.Error("private and group chats share a version, want them to differ")
+	}
+	otherLanguage, _ := k.Version(k.NewTemplateData("Ann", "private", "", "id"))
+	if otherLanguage != private {
+		t.Error("version changed with a field the template does not read")
+	}
+
+	edited, err := (&Knowledge{}).WithPersona(`{{if eq .ChatType "group"}}Be brief.{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := edited.Version(edited.NewTemplateData("Ann", "private", "", "en")); v == private {
+		t.Error("editing the template kept the version")
+	}
+}
@@ -0,0 +1,44 @@
+// Package tts turns bot replies into voice notes.
+package tts
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Synthesizer converts text to speech. It must return OGG audio encoded
+// with Opus, which is the only format WhatsApp plays as a voice note.
+type Synthesizer interface {
+	Synthesize(ctx context.Context, text, language string) ([]byte, error)
+}
+
+// Command runs a shell command that reads the text on stdin and writes an
+// OGG/Opus file to stdout. The reply language is passed in the TTS_LANG
+// environment variable. For example:
+//
+//	piper --model id_ID-news_tts-medium --output-raw | ffmpeg -f s16le -ar 22050 -ac 1 -i - -c:a libopus -f ogg -
+type Command struct {
+	Shell string
+}
+
+func (c Command) Synthesize(ctx context.Context, text, language string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.Shell)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Env = append(os.Environ(), "TTS_LANG="+language)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("tts command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, errors.New("tts command produced no audio")
+	}
+	return stdout.Bytes(), nil
+}
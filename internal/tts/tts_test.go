@@ -0,0 +1,38 @@
+package tts
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCommandSynthesize(t *testing.T) {
+	tests := []struct {
+		name    string
+		shell   string
+		want    string
+		wantErr string
+	}{
+		{name: "reads text from stdin", shell: "cat", want: "halo"},
+		{name: "passes the language", shell: `printf %s "$TTS_LANG"`, want: "id"},
+		{name: "reports failures", shell: "echo broken >&2; exit 1", wantErr: "broken"},
+		{name: "rejects empty audio", shell: "true", wantErr: "no audio"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audio, err := Command{Shell: tt.shell}.Synthesize(context.Background(), "halo", "id")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(audio) != tt.want {
+				t.Errorf("got %q, want %q", audio, tt.want)
+			}
+		})
+	}
+}
@@ -4,169 +4,257 @@ import (
 	"context"
 	"errors"
 	"log"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/generative-ai-go/genai"
-	"google.golang.org/api/option"
 )
 
 type Client struct {
 	keys            []string
+	pool            *clientPool
+	defaults        Options
 	currentKeyIndex int
 	mu              sync.Mutex
 }
 
-func New(apiKeys []string) *Client {
+// New creates a client that rotates through apiKeys. defaults supplies the
+// model and generation parameters for requests that do not override them.
+func New(apiKeys []string, defaults Options) *Client {
 	if len(apiKeys) == 0 {
 		log.Fatal("Cannot create Gemini client with no API keys")
 	}
 	log.Println("Gemini client initialized with key rotation enabled")
 	return &Client{
-		keys: apiKeys,
+		keys:     apiKeys,
+		pool:     newClientPool(apiKeys),
+		defaults: defaults.withDefaults(Options{}),
 	}
 }
 
-func (c *Client) GenerateContent(history []*genai.Content) (string, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// Close releases the connections held for every API key.
+func (c *Client) Close() error {
+	return c.pool.close()
+}
 
-	if len(history) == 0 {
-		return "", errors.New("empty history")
+// DefaultModel returns the model used when a request does not pick one.
+func (c *Client) DefaultModel() string {
+	return c.defaults.Model
+}
+
+// Result is the reply to a request together with the model that produced it,
+// the tokens it used and the index of the API key that served it.
+type Result struct {
+	Text     string
+	Model    string
+	Usage    Usage
+	KeyIndex int
+}
+
+func (c *Client) GenerateContent(history []*genai.Content) (string, error) {
+	res, err := c.GenerateContentWithTools(history, nil, Options{})
+	if err != nil {
+		return "", err
 	}
+	return res.Text, nil
+}
 
-	totalKeys := len(c.keys)
-	for i := 0; i < totalKeys; i++ {
-		key := c.keys[c.currentKeyIndex]
+// GenerateContentWithTools is like GenerateContent but lets the model call
+// the functions in tools before giving its final answer.
+func (c *Client) GenerateContentWithTools(history []*genai.Content, tools *ToolRegistry, opts Options) (*Result, error) {
+	return c.generate(history, tools, opts, nil)
+}
 
-		ctx := context.Background()
-		client, err := genai.NewClient(ctx, option.WithAPIKey(key))
-		if err != nil {
-			log.Printf("Failed to create Gemini client with key index %d: %v", c.currentKeyIndex, err)
-			c.rotateToNextKey()
-			continue
-		}
+// GenerateContentStream streams the reply, calling onChunk with the text
+// received so far. It returns the complete reply once the model is done.
+func (c *Client) GenerateContentStream(history []*genai.Content, tools *ToolRegistry, opts Options, onChunk StreamFunc) (*Result, error) {
+	return c.generate(history, tools, opts, onChunk)
+}
+
+func (c *Client) generate(history []*genai.Content, tools *ToolRegistry, opts Options, onChunk StreamFunc) (*Result, error) {
+	if len(history) == 0 {
+		return nil, errors.New("empty history")
+	}
 
-		model := client.GenerativeModel("gemini-2.5-flash")
+	return c.withFallback(opts, func(ctx context.Context, model *genai.GenerativeModel) (*genai.GenerateContentResponse, error) {
+		model.Tools = tools.genaiTools()
 		cs := model.StartChat()
 		if len(history) > 1 {
 			cs.History = history[0 : len(history)-1]
 		}
 
-		lastPrompt := history[len(history)-1].Parts[0]
-		resp, err := cs.SendMessage(ctx, lastPrompt)
-		client.Close()
+		lastPrompt := history[len(history)-1].Parts
+		return runChat(ctx, cs, tools, onChunk, lastPrompt...)
+	})
+}
 
-		if err != nil {
-			if strings.Contains(err.Error(), "RESOURCE_EXHAUSTED") || strings.Contains(err.Error(), "429") {
-				log.Printf("API key at index %d is rate-limited. Rotating to next key.", c.currentKeyIndex)
-				c.rotateToNextKey()
-				continue
-			}
-			return "", err
+func (c *Client) GenerateContentWithImage(prompt string, mimeType string, imageData []byte, opts Options) (*Result, error) {
+	return c.withFallback(opts, func(ctx context.Context, model *genai.GenerativeModel) (*genai.GenerateContentResponse, error) {
+		content := []genai.Part{
+			genai.ImageData(mimeType, imageData),
+			genai.Text(prompt),
 		}
+		return model.GenerateContent(ctx, content...)
+	})
+}
 
-		if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-			return "No response from model.", nil
+func (c *Client) GenerateContentWithDocument(prompt string, mimeType string, documentData []byte, opts Options) (*Result, error) {
+	return c.GenerateContentWithMedia(prompt, mimeType, documentData, opts)
+}
+
+// GenerateContentWithMedia sends a single file of any MIME type Gemini
+// accepts, such as a PDF or an audio clip, followed by prompt.
+func (c *Client) GenerateContentWithMedia(prompt string, mimeType string, data []byte, opts Options) (*Result, error) {
+	return c.withFallback(opts, func(ctx context.Context, model *genai.GenerativeModel) (*genai.GenerateContentResponse, error) {
+		mediaPart := genai.Blob{
+			MIMEType: mimeType,
+			Data:     data,
 		}
+		promptPart := genai.Text(prompt)
+		return model.GenerateContent(ctx, mediaPart, promptPart)
+	})
+}
 
-		return string(resp.Candidates[0].Content.Parts[0].(genai.Text)), nil
+type modelCall func(ctx context.Context, model *genai.GenerativeModel) (*genai.GenerateContentResponse, error)
+
+// withFallback runs call on the requested model and, when every key is
+// exhausted for it or it keeps failing on the server side, on each fallback
+// model in turn. A retried call reuses the results of functions the model
+// already called, so their side effects happen once.
+func (c *Client) withFallback(opts Options, call modelCall) (*Result, error) {
+	opts = opts.withDefaults(c.defaults)
+
+	var lastErr error
+	for _, name := range opts.modelChain() {
+		modelOpts := opts
+		modelOpts.Model = name
+
+		res, err := c.withKey(name, func(ctx context.Context, client *genai.Client) (*genai.GenerateContentResponse, error) {
+			return call(ctx, modelOpts.newModel(client))
+		})
+		if err == nil {
+			res.Model = name
+			return res, nil
+		}
+		if !shouldFallback(err) {
+			return nil, err
+		}
+		log.Printf("Model %s failed: %v. Trying the next fallback model.", name, err)
+		lastErr = err
 	}
-
-	return "", errors.New("all Gemini API keys are rate-limited or invalid")
+	return nil, lastErr
 }
 
-func (c *Client) GenerateContentWithImage(prompt string, mimeType string, imageData []byte) (string, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// withKey runs call with the pooled client of the next API key usable for
+// model and returns the text and token usage of the response.
+func (c *Client) withKey(model string, call func(ctx context.Context, client *genai.Client) (*genai.GenerateContentResponse, error)) (*Result, error) {
+	var resp *genai.GenerateContentResponse
+	keyIndex, err := c.withClient(model, func(ctx context.Context, client *genai.Client) error {
+		var err error
+		resp, err = call(ctx, client)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
+	res := &Result{Text: responseText(resp), KeyIndex: keyIndex}
+	res.Usage.add(resp.UsageMetadata)
+	if res.Text == "" {
+		res.Text = "No response from model."
+	}
+	return res, nil
+}
+
+// withClient runs call with the pooled client of the next API key usable for
+// model and returns the index of the key that served it. Keys that are
+// rate-limited cool down for the delay the API asks for, keys that are
+// rejected are disabled, and keys whose connection fails get a fresh client.
+// In each case the call is retried on the remaining keys; when none is left
+// the last connection error, or ErrNoAvailableKeys, is returned.
+func (c *Client) withClient(model string, call func(ctx context.Context, client *genai.Client) error) (int, error) {
+	var connErr error
+	connKey := 0
 	totalKeys := len(c.keys)
 	for i := 0; i < totalKeys; i++ {
-		key := c.keys[c.currentKeyIndex]
+		keyIndex, ok := c.nextKey(model)
+		if !ok {
+			break
+		}
 
 		ctx := context.Background()
-		client, err := genai.NewClient(ctx, option.WithAPIKey(key))
+		conn, err := c.pool.get(keyIndex)
 		if err != nil {
-			log.Printf("Failed to create Gemini client with key index %d: %v", c.currentKeyIndex, err)
-			c.rotateToNextKey()
+			log.Printf("Failed to create Gemini client with key index %d: %v", keyIndex, err)
+			c.rotateToNextKey(keyIndex)
 			continue
 		}
 
-		model := client.GenerativeModel("gemini-2.5-flash")
-		content := []genai.Part{
-			genai.ImageData(mimeType, imageData),
-			genai.Text(prompt),
-		}
-
-		resp, err := model.GenerateContent(ctx, content...)
-		client.Close()
-
+		err = call(ctx, conn.client)
+		c.pool.release(keyIndex, conn)
 		if err != nil {
-			if strings.Contains(err.Error(), "RESOURCE_EXHAUSTED") || strings.Contains(err.Error(), "429") {
-				log.Printf("API key at index %d is rate-limited. Rotating to next key.", c.currentKeyIndex)
-				c.rotateToNextKey()
+			kind, retryDelay := classifyError(err)
+			switch kind {
+			case errRateLimited:
+				c.pool.cooldown(keyIndex, model, retryDelay, err)
+				c.rotateToNextKey(keyIndex)
+				continue
+			case errAuth:
+				c.pool.disable(keyIndex, err)
+				c.rotateToNextKey(keyIndex)
+				continue
+			case errConnection:
+				c.pool.reset(keyIndex, conn, err)
+				c.rotateToNextKey(keyIndex)
+				connErr, connKey = err, keyIndex
 				continue
+			default:
+				c.pool.markFailure(keyIndex, err)
 			}
-			return "", err
-		}
-
-		if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-			return "No response from model.", nil
+			return keyIndex, err
 		}
+		c.pool.markSuccess(keyIndex)
+		return keyIndex, nil
+	}
 
-		return string(resp.Candidates[0].Content.Parts[0].(genai.Text)), nil
+	if connErr != nil {
+		return connKey, connErr
 	}
+	return 0, ErrNoAvailableKeys
+}
 
-	return "", errors.New("all Gemini API keys are rate-limited or invalid")
+// KeyStats reports the health of every API key.
+func (c *Client) KeyStats() []KeyStats {
+	return c.pool.stats()
 }
 
-func (c *Client) GenerateContentWithDocument(prompt string, mimeType string, documentData []byte) (string, error) {
+// nextKey returns the first key usable for model starting from the current
+// one, skipping keys that are cooling down or disabled.
+func (c *Client) nextKey(model string) (int, bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	now := time.Now()
 	totalKeys := len(c.keys)
 	for i := 0; i < totalKeys; i++ {
-		key := c.keys[c.currentKeyIndex]
-
-		ctx := context.Background()
-		client, err := genai.NewClient(ctx, option.WithAPIKey(key))
-		if err != nil {
-			log.Printf("Failed to create Gemini client with key index %d: %v", c.currentKeyIndex, err)
-			c.rotateToNextKey()
-			continue
+		index := (c.currentKeyIndex + i) % totalKeys
+		if c.pool.available(index, model, now) {
+			c.currentKeyIndex = index
+			return index, true
 		}
-
-		model := client.GenerativeModel("gemini-2.5-flash")
-		pdfPart := genai.Blob{
-			MIMEType: mimeType,
-			Data:     documentData,
-		}
-		promptPart := genai.Text(prompt)
-
-		resp, err := model.GenerateContent(ctx, pdfPart, promptPart)
-		client.Close()
-
-		if err != nil {
-			if strings.Contains(err.Error(), "RESOURCE_EXHAUSTED") || strings.Contains(err.Error(), "429") {
-				log.Printf("API key at index %d is rate-limited. Rotating to next key.", c.currentKeyIndex)
-				c.rotateToNextKey()
-				continue
-			}
-			return "", err
-		}
-
-		if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-			return "No response from model.", nil
-		}
-
-		return string(resp.Candidates[0].Content.Parts[0].(genai.Text)), nil
 	}
-
-	return "", errors.New("all Gemini API keys are rate-limited or invalid")
+	return 0, false
 }
 
-func (c *Client) rotateToNextKey() {
+// rotateToNextKey moves past the key at index from. Concurrent requests that
+// fail on the same key only rotate once.
+func (c *Client) rotateToNextKey(from int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.currentKeyIndex != from {
+		return
+	}
 	totalKeys := len(c.keys)
 	c.currentKeyIndex = (c.currentKeyIndex + 1) % totalKeys
 	log.Printf("Rotated to next key index: %d", c.currentKeyIndex)
-}
\ No newline at end of file
+}
@@ -0,0 +1,59 @@
+package gemini
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// DefaultEmbeddingModel is used by EmbedTexts when no model is given.
+const DefaultEmbeddingModel = "text-embedding-004"
+
+// maxEmbedBatch is the largest number of texts the API embeds per request.
+const maxEmbedBatch = 100
+
+// EmbedTexts returns one embedding vector per text, computed with the
+// embedding model named by model, and the usage of the requests. The API
+// reports no token counts for embeddings, so the usage is estimated from the
+// texts.
+func (c *Client) EmbedTexts(model string, texts []string) ([][]float32, *Result, error) {
+	if model == "" {
+		model = DefaultEmbeddingModel
+	}
+
+	res := &Result{Model: model}
+	vectors := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += maxEmbedBatch {
+		end := min(start+maxEmbedBatch, len(texts))
+		batch := texts[start:end]
+
+		var resp *genai.BatchEmbedContentsResponse
+		keyIndex, err := c.withClient(model, func(ctx context.Context, client *genai.Client) error {
+			em := client.EmbeddingModel(model)
+			b := em.NewBatch()
+			for _, text := range batch {
+				b.AddContent(genai.Text(text))
+			}
+			var err error
+			resp, err = em.BatchEmbedContents(ctx, b)
+			return err
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		res.KeyIndex = keyIndex
+		for _, text := range batch {
+			tokens := EstimateTokens(text)
+			res.Usage.PromptTokens += tokens
+			res.Usage.TotalTokens += tokens
+		}
+		if len(resp.Embeddings) != len(batch) {
+			return nil, nil, fmt.Errorf("expected %d embeddings, got %d", len(batch), len(resp.Embeddings))
+		}
+		for _, e := range resp.Embeddings {
+			vectors = append(vectors, e.Values)
+		}
+	}
+	return vectors, res, nil
+}
@@ -0,0 +1,77 @@
+package gemini
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/googleapis/gax-go/v2/apierror"
+	"google.golang.org/grpc/codes"
+)
+
+// ErrNoAvailableKeys is returned when every API key is cooling down after
+// rate limiting or has been disabled.
+var ErrNoAvailableKeys = errors.New("all Gemini API keys are rate-limited or invalid")
+
+// defaultCooldown is used when a rate-limit error carries no retry delay.
+const defaultCooldown = time.Minute
+
+type errorKind int
+
+const (
+	errOther errorKind = iota
+	errRateLimited
+	errAuth
+	errConnection
+	errServer
+)
+
+// classifyError inspects the status code of an API error. For rate-limit
+// errors it also returns the retry delay suggested by the server, if any.
+func classifyError(err error) (errorKind, time.Duration) {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return errConnection, 0
+	}
+
+	ae, ok := apierror.FromError(err)
+	if !ok {
+		return errOther, 0
+	}
+
+	code := ae.HTTPCode()
+	var grpcCode codes.Code = codes.OK
+	if s := ae.GRPCStatus(); s != nil {
+		grpcCode = s.Code()
+	}
+
+	switch {
+	case code == http.StatusTooManyRequests || grpcCode == codes.ResourceExhausted:
+		var delay time.Duration
+		if info := ae.Details().RetryInfo; info != nil {
+			delay = info.GetRetryDelay().AsDuration()
+		}
+		return errRateLimited, delay
+	case code == http.StatusUnauthorized || code == http.StatusForbidden,
+		grpcCode == codes.Unauthenticated || grpcCode == codes.PermissionDenied,
+		ae.Reason() == "API_KEY_INVALID":
+		return errAuth, 0
+	case grpcCode == codes.Unavailable:
+		return errConnection, 0
+	case code >= http.StatusInternalServerError || code == http.StatusNotFound,
+		grpcCode == codes.Internal || grpcCode == codes.NotFound:
+		return errServer, 0
+	}
+	return errOther, 0
+}
+
+// shouldFallback reports whether a request that failed with err may succeed
+// on a different model.
+func shouldFallback(err error) bool {
+	if errors.Is(err, ErrNoAvailableKeys) {
+		return true
+	}
+	kind, _ := classifyError(err)
+	return kind == errServer || kind == errConnection
+}
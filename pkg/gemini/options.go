@@ -0,0 +1,123 @@
+package gemini
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// defaultModelName is used when neither the client defaults nor a request
+// name a model.
+const defaultModelName = "gemini-2.5-flash"
+
+// Options selects the model and generation parameters of a request. Zero
+// fields fall back to the client defaults. FallbackModels lists, in order,
+// the models to try when Model is exhausted or failing.
+type Options struct {
+	Model             string
+	FallbackModels    []string
+	Temperature       *float32
+	TopP              *float32
+	MaxOutputTokens   *int32
+	SafetySettings    []*genai.SafetySetting
+	SystemInstruction string
+}
+
+// withDefaults fills the unset fields of o from def.
+func (o Options) withDefaults(def Options) Options {
+	if o.Model == "" {
+		o.Model = def.Model
+	}
+	if o.Model == "" {
+		o.Model = defaultModelName
+	}
+	if o.FallbackModels == nil {
+		o.FallbackModels = def.FallbackModels
+	}
+	if o.Temperature == nil {
+		o.Temperature = def.Temperature
+	}
+	if o.TopP == nil {
+		o.TopP = def.TopP
+	}
+	if o.MaxOutputTokens == nil {
+		o.MaxOutputTokens = def.MaxOutputTokens
+	}
+	if o.SafetySettings == nil {
+		o.SafetySettings = def.SafetySettings
+	}
+	if o.SystemInstruction == "" {
+		o.SystemInstruction = def.SystemInstruction
+	}
+	return o
+}
+
+// newModel returns the model named in o configured with its parameters.
+func (o Options) newModel(client *genai.Client) *genai.GenerativeModel {
+	model := client.GenerativeModel(o.Model)
+	if o.Temperature != nil {
+		model.SetTemperature(*o.Temperature)
+	}
+	if o.TopP != nil {
+		model.SetTopP(*o.TopP)
+	}
+	if o.MaxOutputTokens != nil {
+		model.SetMaxOutputTokens(*o.MaxOutputTokens)
+	}
+	model.SafetySettings = o.SafetySettings
+	if o.SystemInstruction != "" {
+		model.SystemInstruction = genai.NewUserContent(genai.Text(o.SystemInstruction))
+	}
+	return model
+}
+
+// modelChain returns the models to try in order. When Model appears in the
+// fallback list only the models after it are used as fallbacks, so a chat
+// on flash never escalates to pro.
+func (o Options) modelChain() []string {
+	chain := []string{o.Model}
+	start := 0
+	for i, name := range o.FallbackModels {
+		if name == o.Model {
+			start = i + 1
+			break
+		}
+	}
+	for _, name := range o.FallbackModels[start:] {
+		if name != o.Model {
+			chain = append(chain, name)
+		}
+	}
+	return chain
+}
+
+var safetyThresholds = map[string]genai.HarmBlockThreshold{
+	"none":   genai.HarmBlockNone,
+	"high":   genai.HarmBlockOnlyHigh,
+	"medium": genai.HarmBlockMediumAndAbove,
+	"low":    genai.HarmBlockLowAndAbove,
+}
+
+// SafetySettings applies one block threshold ("none", "high", "medium" or
+// "low") to every harm category. An empty threshold keeps the API defaults.
+func SafetySettings(threshold string) ([]*genai.SafetySetting, error) {
+	if threshold == "" {
+		return nil, nil
+	}
+	block, ok := safetyThresholds[strings.ToLower(threshold)]
+	if !ok {
+		return nil, fmt.Errorf("unknown safety threshold %q", threshold)
+	}
+	categories := []genai.HarmCategory{
+		genai.HarmCategoryHarassment,
+		genai.HarmCategoryHateSpeech,
+		genai.HarmCategorySexuallyExplicit,
+		genai.HarmCategoryDangerousContent,
+	}
+	settings := make([]*genai.SafetySetting, 0, len(categories))
+	for _, category := range categories {
+		settings = append(settings, &genai.SafetySetting{Category: category, Threshold: block})
+	}
+	return settings, nil
+}
@@ -0,0 +1,237 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/option"
+)
+
+// pooledClient is a long-lived genai client for a single API key together
+// with the key's health. The connection is dialed on first use and redialed
+// after a transport failure.
+type pooledClient struct {
+	mu        sync.Mutex
+	key       string
+	conn      *clientConn
+	healthy   bool
+	lastErr   error
+	cooldowns map[string]time.Time
+	disabled  bool
+	successes int
+	failures  int
+}
+
+// KeyStats is a snapshot of the health of one API key. Cooldowns lists the
+// models the key is currently rate-limited on.
+type KeyStats struct {
+	Index     int
+	MaskedKey string
+	Healthy   bool
+	Disabled  bool
+	Cooldowns map[string]time.Time
+	Successes int
+	Failures  int
+	LastError string
+}
+
+// clientConn is one dialed genai client, shared by every request on its key.
+// A connection that is replaced is closed once the last request using it
+// releases it, so a reset does not abort requests still in flight.
+type clientConn struct {
+	client  *genai.Client
+	users   int
+	retired bool
+}
+
+type clientPool struct {
+	clients []*pooledClient
+}
+
+func newClientPool(keys []string) *clientPool {
+	p := &clientPool{}
+	for _, key := range keys {
+		p.clients = append(p.clients, &pooledClient{
+			key:       key,
+			healthy:   true,
+			cooldowns: make(map[string]time.Time),
+		})
+	}
+	return p
+}
+
+// available reports whether the key at index may be used for model right
+// now. Quotas are tracked per model, so a key that is cooling down for one
+// model may still serve another.
+func (p *clientPool) available(index int, model string, now time.Time) bool {
+	pc := p.clients[index]
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return !pc.disabled && !now.Before(pc.cooldowns[model])
+}
+
+// get returns the connection for the key at index, dialing it if needed.
+// The caller must hand it back with release when its request is done.
+func (p *clientPool) get(index int) (*clientConn, error) {
+	pc := p.clients[index]
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.conn == nil {
+		client, err := genai.NewClient(context.Background(), option.WithAPIKey(pc.key))
+		if err != nil {
+			pc.healthy = false
+			pc.lastErr = err
+			pc.failures++
+			return nil, err
+		}
+		log.Printf("Connected Gemini client for key index %d", index)
+		pc.conn = &clientConn{client: client}
+	}
+	pc.conn.users++
+	return pc.conn, nil
+}
+
+// release hands back a connection returned by get, closing it if it was
+// retired and this was its last user.
+func (p *clientPool) release(index int, conn *clientConn) {
+	pc := p.clients[index]
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	conn.users--
+	if conn.retired && conn.users == 0 {
+		closeConn(index, conn)
+	}
+}
+
+// reset retires conn, the connection for the key at index that failed, so
+// the next request redials. A connection that was already replaced by an
+// earlier reset is left alone.
+func (p *clientPool) reset(index int, conn *clientConn, cause error) {
+	pc := p.clients[index]
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.healthy = false
+	pc.lastErr = cause
+	pc.failures++
+	if pc.conn != conn {
+		return
+	}
+	pc.conn = nil
+	conn.retired = true
+	if conn.users == 0 {
+		closeConn(index, conn)
+	}
+	log.Printf("Reset Gemini client for key index %d after error: %v", index, cause)
+}
+
+func closeConn(index int, conn *clientConn) {
+	if err := conn.client.Close(); err != nil {
+		log.Printf("Failed to close Gemini client for key index %d: %v", index, err)
+	}
+}
+
+func (p *clientPool) markSuccess(index int) {
+	pc := p.clients[index]
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.healthy = true
+	pc.lastErr = nil
+	pc.successes++
+}
+
+func (p *clientPool) markFailure(index int, cause error) {
+	pc := p.clients[index]
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.lastErr = cause
+	pc.failures++
+}
+
+// cooldown keeps the key at index out of rotation for model until delay has
+// passed.
+func (p *clientPool) cooldown(index int, model string, delay time.Duration, cause error) {
+	if delay <= 0 {
+		delay = defaultCooldown
+	}
+	pc := p.clients[index]
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.cooldowns[model] = time.Now().Add(delay)
+	pc.lastErr = cause
+	pc.failures++
+	log.Printf("API key at index %d is rate-limited for %s, cooling down for %s", index, model, delay)
+}
+
+// disable removes the key at index from rotation for the life of the process.
+func (p *clientPool) disable(index int, cause error) {
+	pc := p.clients[index]
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.disabled = true
+	pc.healthy = false
+	pc.lastErr = cause
+	pc.failures++
+	log.Printf("API key at index %d was rejected and has been disabled: %v", index, cause)
+}
+
+func (p *clientPool) stats() []KeyStats {
+	now := time.Now()
+	stats := make([]KeyStats, 0, len(p.clients))
+	for i, pc := range p.clients {
+		pc.mu.Lock()
+		s := KeyStats{
+			Index:     i,
+			MaskedKey: maskKey(pc.key),
+			Healthy:   pc.healthy,
+			Disabled:  pc.disabled,
+			Cooldowns: make(map[string]time.Time),
+			Successes: pc.successes,
+			Failures:  pc.failures,
+		}
+		for model, until := range pc.cooldowns {
+			if now.Before(until) {
+				s.Cooldowns[model] = until
+			}
+		}
+		if pc.lastErr != nil {
+			s.LastError = pc.lastErr.Error()
+		}
+		pc.mu.Unlock()
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// close closes every idle connection and retires the ones in use, which
+// are closed as their requests finish.
+func (p *clientPool) close() error {
+	var errs []error
+	for _, pc := range p.clients {
+		pc.mu.Lock()
+		if conn := pc.conn; conn != nil {
+			pc.conn = nil
+			conn.retired = true
+			if conn.users == 0 {
+				if err := conn.client.Close(); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+		pc.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// maskKey hides all but the last four characters of an API key.
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+	return "****" + key[len(key)-4:]
+}
@@ -0,0 +1,10 @@
+package gemini
+
+import "unicode/utf8"
+
+// EstimateTokens approximates the number of tokens in text without calling
+// the API. Gemini averages about four characters per token, so the estimate
+// errs on the high side for most chat text.
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
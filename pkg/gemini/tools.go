@@ -0,0 +1,212 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+)
+
+// maxToolRounds bounds the call/response loop so a model that keeps calling
+// functions cannot spin forever.
+const maxToolRounds = 5
+
+// ToolFunc implements a function exposed to Gemini. The returned map is sent
+// back to the model as the function response.
+type ToolFunc func(ctx context.Context, args map[string]any) (map[string]any, error)
+
+type tool struct {
+	decl *genai.FunctionDeclaration
+	fn   ToolFunc
+}
+
+// ToolRegistry holds the Go functions Gemini may call during a request.
+type ToolRegistry struct {
+	tools  map[string]*tool
+	order  []string
+	called bool
+	// results holds the response of every call that succeeded, keyed by
+	// name and arguments. A request retried on another key or model gets
+	// them back instead of running a function such as sending the menu a
+	// second time.
+	results map[string]map[string]any
+}
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{
+		tools:   make(map[string]*tool),
+		results: make(map[string]map[string]any),
+	}
+}
+
+// Register exposes fn to the model under decl.Name.
+func (r *ToolRegistry) Register(decl *genai.FunctionDeclaration, fn ToolFunc) {
+	if _, exists := r.tools[decl.Name]; !exists {
+		r.order = append(r.order, decl.Name)
+	}
+	r.tools[decl.Name] = &tool{decl: decl, fn: fn}
+}
+
+func (r *ToolRegistry) empty() bool {
+	return r == nil || len(r.tools) == 0
+}
+
+// Called reports whether the model called any of the functions, which
+// means the reply depended on their side effects.
+func (r *ToolRegistry) Called() bool {
+	return r != nil && r.called
+}
+
+// genaiTools returns the declarations in the form the model expects.
+func (r *ToolRegistry) genaiTools() []*genai.Tool {
+	if r.empty() {
+		return nil
+	}
+	decls := make([]*genai.FunctionDeclaration, 0, len(r.order))
+	for _, name := range r.order {
+		decls = append(decls, r.tools[name].decl)
+	}
+	return []*genai.Tool{{FunctionDeclarations: decls}}
+}
+
+// call runs the function requested by the model. Errors are reported back to
+// the model instead of aborting the request so it can explain the failure.
+func (r *ToolRegistry) call(ctx context.Context, fc genai.FunctionCall) genai.FunctionResponse {
+	t, ok := r.tools[fc.Name]
+	if !ok {
+		log.Printf("Gemini called unknown function %s", fc.Name)
+		return genai.FunctionResponse{
+			Name:     fc.Name,
+			Response: map[string]any{"error": fmt.Sprintf("unknown function %q", fc.Name)},
+		}
+	}
+
+	r.called = true
+	key := callKey(fc)
+	if result, ok := r.results[key]; ok {
+		log.Printf("Gemini called function %s again with args %v, reusing the earlier result", fc.Name, fc.Args)
+		return genai.FunctionResponse{Name: fc.Name, Response: result}
+	}
+
+	log.Printf("Gemini called function %s with args %v", fc.Name, fc.Args)
+	result, err := t.fn(ctx, fc.Args)
+	if err != nil {
+		log.Printf("Function %s failed: %v", fc.Name, err)
+		return genai.FunctionResponse{
+			Name:     fc.Name,
+			Response: map[string]any{"error": err.Error()},
+		}
+	}
+	if result == nil {
+		result = map[string]any{"status": "ok"}
+	}
+	r.results[key] = result
+	return genai.FunctionResponse{Name: fc.Name, Response: result}
+}
+
+// callKey identifies a function call by its name and arguments. Map keys are
+// marshalled in sorted order, so equal arguments give equal keys.
+func callKey(fc genai.FunctionCall) string {
+	args, err := json.Marshal(fc.Args)
+	if err != nil {
+		args = []byte(fmt.Sprint(fc.Args))
+	}
+	return fc.Name + "\x00" + string(args)
+}
+
+// responseText joins the text parts of the first candidate. Non-text parts
+// such as function calls are skipped.
+func responseText(resp *genai.GenerateContentResponse) string {
+	if resp == nil || len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil {
+		return ""
+	}
+	var text string
+	for _, part := range resp.Candidates[0].Content.Parts {
+		if t, ok := part.(genai.Text); ok {
+			text += string(t)
+		}
+	}
+	return text
+}
+
+// StreamFunc receives the reply text accumulated so far each time a new
+// chunk arrives from the model.
+type StreamFunc func(text string)
+
+// runChat sends parts to cs and keeps answering function calls until the
+// model produces a reply without any. When onChunk is set the replies are
+// streamed and onChunk is called as text arrives.
+func runChat(ctx context.Context, cs *genai.ChatSession, tools *ToolRegistry, onChunk StreamFunc, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	send := func(parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+		if onChunk == nil {
+			return cs.SendMessage(ctx, parts...)
+		}
+		return streamMessage(ctx, cs, onChunk, parts...)
+	}
+
+	resp, err := send(parts...)
+	if err != nil {
+		return nil, err
+	}
+	// Every round is billed, so report the usage of all of them.
+	var usage genai.UsageMetadata
+	addUsageMetadata(&usage, resp.UsageMetadata)
+
+	for round := 0; round < maxToolRounds && !tools.empty(); round++ {
+		if len(resp.Candidates) == 0 {
+			break
+		}
+		calls := resp.Candidates[0].FunctionCalls()
+		if len(calls) == 0 {
+			break
+		}
+
+		responses := make([]genai.Part, 0, len(calls))
+		for _, fc := range calls {
+			responses = append(responses, tools.call(ctx, fc))
+		}
+		resp, err = send(responses...)
+		if err != nil {
+			return nil, err
+		}
+		addUsageMetadata(&usage, resp.UsageMetadata)
+	}
+	resp.UsageMetadata = &usage
+	return resp, nil
+}
+
+// streamMessage sends parts with a streaming request and returns the merged
+// response once the stream ends.
+func streamMessage(ctx context.Context, cs *genai.ChatSession, onChunk StreamFunc, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	iter := cs.SendMessageStream(ctx, parts...)
+	var text string
+	var usage *genai.UsageMetadata
+	for {
+		resp, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The last chunk carries the usage of the whole response, which the
+		// merged response does not keep.
+		if resp.UsageMetadata != nil {
+			usage = resp.UsageMetadata
+		}
+		if chunk := responseText(resp); chunk != "" {
+			text += chunk
+			onChunk(text)
+		}
+	}
+	merged := iter.MergedResponse()
+	if merged == nil {
+		return nil, errors.New("empty response from model")
+	}
+	merged.UsageMetadata = usage
+	return merged, nil
+}
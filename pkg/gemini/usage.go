@@ -0,0 +1,110 @@
+package gemini
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// Usage is the number of tokens a request was billed for.
+type Usage struct {
+	PromptTokens    int
+	CandidateTokens int
+	TotalTokens     int
+}
+
+func (u *Usage) add(m *genai.UsageMetadata) {
+	if m == nil {
+		return
+	}
+	u.PromptTokens += int(m.PromptTokenCount)
+	u.CandidateTokens += int(m.CandidatesTokenCount)
+	u.TotalTokens += int(m.TotalTokenCount)
+}
+
+// addUsageMetadata adds the counts of m to total.
+func addUsageMetadata(total, m *genai.UsageMetadata) {
+	if m == nil {
+		return
+	}
+	total.PromptTokenCount += m.PromptTokenCount
+	total.CachedContentTokenCount += m.CachedContentTokenCount
+	total.CandidatesTokenCount += m.CandidatesTokenCount
+	total.TotalTokenCount += m.TotalTokenCount
+}
+
+// Price is what a model costs in US dollars per million input and output
+// tokens.
+type Price struct {
+	Input  float64
+	Output float64
+}
+
+// Cost returns the estimated cost in US dollars of a request billed at p.
+// Every token beyond the prompt is output, which on 2.5 models includes the
+// thinking tokens as well as the candidates.
+func (p Price) Cost(promptTokens, totalTokens int64) float64 {
+	output := max(totalTokens-promptTokens, 0)
+	return (float64(promptTokens)*p.Input + float64(output)*p.Output) / 1e6
+}
+
+// DefaultPrices are the list prices of the default models for prompts up to
+// 200k tokens. They are only used to estimate costs.
+var DefaultPrices = map[string]Price{
+	"gemini-2.5-pro":        {Input: 1.25, Output: 10},
+	"gemini-2.5-flash":      {Input: 0.30, Output: 2.50},
+	"gemini-2.5-flash-lite": {Input: 0.10, Output: 0.40},
+}
+
+// ParsePrices reads a price table such as
+// "gemini-2.5-flash=0.30/2.50,gemini-2.5-pro=1.25/10" on top of
+// DefaultPrices. Each entry gives the input and output price per million
+// tokens.
+func ParsePrices(value string) (map[string]Price, error) {
+	prices := make(map[string]Price, len(DefaultPrices))
+	for model, price := range DefaultPrices {
+		prices[model] = price
+	}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, rates, ok := strings.Cut(entry, "=")
+		input, output, ok2 := strings.Cut(rates, "/")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid price %q, want model=input/output", entry)
+		}
+		in, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input price in %q: %w", entry, err)
+		}
+		out, err := strconv.ParseFloat(strings.TrimSpace(output), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid output price in %q: %w", entry, err)
+		}
+		prices[strings.TrimSpace(model)] = Price{Input: in, Output: out}
+	}
+	return prices, nil
+}
+
+// PriceFor returns the price of model in prices. A versioned model such as
+// "gemini-2.5-flash-preview-05-20" uses the price of the longest name it
+// starts with.
+func PriceFor(prices map[string]Price, model string) (Price, bool) {
+	if p, ok := prices[model]; ok {
+		return p, true
+	}
+	var best string
+	for name := range prices {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return Price{}, false
+	}
+	return prices[best], true
+}